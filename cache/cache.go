@@ -2,9 +2,12 @@ package cache
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
+	"github.com/redis/go-redis/v9"
+	"github.com/vela-games/lfsproxy/config"
 )
 
 type Cache interface {
@@ -13,6 +16,15 @@ type Cache interface {
 	Delete(key string) error
 }
 
+// ErrEntryNotFound is returned by every Cache on misses
+var ErrEntryNotFound = bigcache.ErrEntryNotFound
+
+const (
+	BackendMemory  = "memory"
+	BackendRedis   = "redis"
+	BackendLayered = "layered"
+)
+
 func NewCache(ctx context.Context, cacheEviction time.Duration) (Cache, error) {
 	cache, err := bigcache.New(ctx, bigcache.DefaultConfig(cacheEviction))
 	if err != nil {
@@ -21,3 +33,60 @@ func NewCache(ctx context.Context, cacheEviction time.Duration) (Cache, error) {
 
 	return cache, nil
 }
+
+// Builder builds the caches of the proxy on the backend selected by APP_CACHE_BACKEND.
+// Caches built on Redis share its client and are shared by every replica of the proxy
+type Builder struct {
+	backend  string
+	client   *redis.Client
+	localTTL time.Duration
+}
+
+func NewBuilder(cfg *config.Config) (*Builder, error) {
+	builder := &Builder{
+		backend:  cfg.CacheBackend,
+		localTTL: cfg.CacheLocalTTL,
+	}
+
+	switch cfg.CacheBackend {
+	case BackendMemory:
+	case BackendRedis, BackendLayered:
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("APP_REDIS_URL is required by the %v cache backend", cfg.CacheBackend)
+		}
+
+		options, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		builder.client = redis.NewClient(options)
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.CacheBackend)
+	}
+
+	return builder, nil
+}
+
+// New builds a cache whose entries expire after ttl. name scopes its keys on Redis
+// so the caches of the proxy don't collide
+func (b *Builder) New(ctx context.Context, name string, ttl time.Duration) (Cache, error) {
+	switch b.backend {
+	case BackendRedis:
+		return NewRedisCache(b.client, name, ttl), nil
+	case BackendLayered:
+		// Entries deleted on another replica linger on the local cache for up to localTTL
+		localTTL := ttl
+		if b.localTTL > 0 && b.localTTL < ttl {
+			localTTL = b.localTTL
+		}
+
+		local, err := NewCache(ctx, localTTL)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewLayeredCache(local, NewRedisCache(b.client, name, ttl)), nil
+	default:
+		return NewCache(ctx, ttl)
+	}
+}
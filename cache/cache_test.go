@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/config"
+)
+
+func TestRedisCache(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	builder, err := NewBuilder(&config.Config{CacheBackend: BackendRedis, RedisURL: "redis://" + server.Addr()})
+	require.NoError(t, err)
+
+	cache, err := builder.New(context.Background(), "objects", 1*time.Hour)
+	require.NoError(t, err)
+
+	t.Run("it should store entries with the cache ttl", func(t *testing.T) {
+		require.NoError(t, cache.Set("test-oid", []byte("entry")))
+
+		entry, err := cache.Get("test-oid")
+		assert.NoError(t, err)
+		assert.Equal(t, "entry", string(entry))
+		assert.Equal(t, 1*time.Hour, server.TTL("lfsproxy:objects:test-oid"))
+	})
+
+	t.Run("it should expire entries", func(t *testing.T) {
+		require.NoError(t, cache.Set("expiring-oid", []byte("entry")))
+		server.FastForward(2 * time.Hour)
+
+		_, err := cache.Get("expiring-oid")
+		assert.ErrorIs(t, err, ErrEntryNotFound)
+	})
+
+	t.Run("it should delete entries", func(t *testing.T) {
+		require.NoError(t, cache.Set("test-oid", []byte("entry")))
+		require.NoError(t, cache.Delete("test-oid"))
+
+		_, err := cache.Get("test-oid")
+		assert.ErrorIs(t, err, ErrEntryNotFound)
+	})
+
+	t.Run("it should scope the keys of each cache", func(t *testing.T) {
+		auth, err := builder.New(context.Background(), "auth", 1*time.Hour)
+		require.NoError(t, err)
+
+		require.NoError(t, cache.Set("shared-key", []byte("object")))
+		_, err = auth.Get("shared-key")
+		assert.ErrorIs(t, err, ErrEntryNotFound)
+	})
+}
+
+func TestLayeredCache(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	// Two replicas of the proxy sharing the same Redis
+	newReplica := func() Cache {
+		builder, err := NewBuilder(&config.Config{
+			CacheBackend:  BackendLayered,
+			CacheLocalTTL: 1 * time.Minute,
+			RedisURL:      "redis://" + server.Addr(),
+		})
+		require.NoError(t, err)
+
+		cache, err := builder.New(context.Background(), "objects", 1*time.Hour)
+		require.NoError(t, err)
+
+		return cache
+	}
+	first, second := newReplica(), newReplica()
+
+	t.Run("it should share entries between replicas", func(t *testing.T) {
+		require.NoError(t, first.Set("test-oid", []byte("entry")))
+
+		entry, err := second.Get("test-oid")
+		assert.NoError(t, err)
+		assert.Equal(t, "entry", string(entry))
+	})
+
+	t.Run("it should serve local entries without Redis", func(t *testing.T) {
+		require.NoError(t, first.Set("local-oid", []byte("entry")))
+		server.Del("lfsproxy:objects:local-oid")
+
+		entry, err := first.Get("local-oid")
+		assert.NoError(t, err)
+		assert.Equal(t, "entry", string(entry))
+	})
+
+	t.Run("it should delete entries from both layers", func(t *testing.T) {
+		require.NoError(t, first.Set("deleted-oid", []byte("entry")))
+		require.NoError(t, first.Delete("deleted-oid"))
+
+		_, err := first.Get("deleted-oid")
+		assert.ErrorIs(t, err, ErrEntryNotFound)
+		_, err = second.Get("deleted-oid")
+		assert.ErrorIs(t, err, ErrEntryNotFound)
+	})
+}
+
+func TestNewBuilder(t *testing.T) {
+	t.Run("it should require a Redis url", func(t *testing.T) {
+		_, err := NewBuilder(&config.Config{CacheBackend: BackendRedis})
+		assert.Error(t, err)
+	})
+
+	t.Run("it should reject unknown backends", func(t *testing.T) {
+		_, err := NewBuilder(&config.Config{CacheBackend: "memcached"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,49 @@
+package cache
+
+import "errors"
+
+// LayeredCache keeps a local copy of the entries of a shared cache.
+// Entries are looked up locally first, and written and deleted on both layers
+type LayeredCache struct {
+	local  Cache
+	shared Cache
+}
+
+func NewLayeredCache(local Cache, shared Cache) *LayeredCache {
+	return &LayeredCache{
+		local:  local,
+		shared: shared,
+	}
+}
+
+func (l LayeredCache) Get(key string) ([]byte, error) {
+	if entry, err := l.local.Get(key); err == nil {
+		return entry, nil
+	}
+
+	entry, err := l.shared.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	l.local.Set(key, entry) //nolint:errcheck
+
+	return entry, nil
+}
+
+func (l LayeredCache) Set(key string, entry []byte) error {
+	if err := l.shared.Set(key, entry); err != nil {
+		return err
+	}
+
+	return l.local.Set(key, entry)
+}
+
+func (l LayeredCache) Delete(key string) error {
+	err := l.shared.Delete(key)
+	if localErr := l.local.Delete(key); localErr != nil && !errors.Is(localErr, ErrEntryNotFound) {
+		err = errors.Join(err, localErr)
+	}
+
+	return err
+}
@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache stores entries on Redis under a key prefix, each of them expiring after ttl
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func NewRedisCache(client *redis.Client, prefix string, ttl time.Duration) *RedisCache {
+	return &RedisCache{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+func (r RedisCache) key(key string) string {
+	return "lfsproxy:" + r.prefix + ":" + key
+}
+
+func (r RedisCache) Get(key string) ([]byte, error) {
+	entry, err := r.client.Get(context.Background(), r.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrEntryNotFound
+	}
+
+	return entry, err
+}
+
+func (r RedisCache) Set(key string, entry []byte) error {
+	return r.client.Set(context.Background(), r.key(key), entry, r.ttl).Err()
+}
+
+func (r RedisCache) Delete(key string) error {
+	return r.client.Del(context.Background(), r.key(key)).Err()
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/vela-games/lfsproxy/config"
+	"github.com/vela-games/lfsproxy/logging"
 	"github.com/vela-games/lfsproxy/router"
+	"github.com/vela-games/lfsproxy/tracing"
 
 	"context"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 const PORT = 8080
@@ -32,7 +36,28 @@ func main() {
 	ctx := NewSigKillContext()
 	cfg, err := config.GetConfig()
 	if err != nil {
-		log.Panicf("error getting configuration: %v", err)
+		slog.Error("error getting configuration", "error", err)
+		os.Exit(1)
+	}
+
+	slog.SetDefault(logging.NewLogger(os.Stdout, cfg.DebugMode))
+
+	if cfg.TracingEnabled {
+		shutdown, err := tracing.Setup(ctx, cfg.TracingSampleRatio)
+		if err != nil {
+			slog.Error("error setting up tracing", "error", err)
+			os.Exit(1)
+		}
+
+		defer func() {
+			// Spans of the drain are flushed once the server is gone, so they get a deadline of their own
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := shutdown(flushCtx); err != nil {
+				slog.Error("error flushing spans", "error", err)
+			}
+		}()
 	}
 
 	router := router.NewRouter()
@@ -42,7 +67,10 @@ func main() {
 	}
 
 	err = router.Run(ctx, fmt.Sprintf(":%v", PORT))
-	if err != nil {
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Whatever didn't complete within the drain period was aborted, queued fills and uploads resume on the next start
+		slog.Warn("drain period elapsed before draining completed", "error", err)
+	} else if err != nil {
 		panic(err)
 	}
 
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -8,13 +9,63 @@ import (
 
 type Config struct {
 	DebugMode                bool          `split_words:"true" default:"false"`
-	UpstreamBaseURL          string        `split_words:"true" required:"true"`
+	UpstreamBaseURL          string        `split_words:"true"`
+	RoutesFile               string        `split_words:"true"`
+	CrossRepositoryDedupe    bool          `split_words:"true" default:"false"`
+	DegradedModeEnabled      bool          `split_words:"true" default:"false"`
+	AuthCheckEnabled         bool          `split_words:"true" default:"false"`
+	AuthCheckTTL             time.Duration `split_words:"true" default:"5m"`
 	CacheEviction            time.Duration `split_words:"true" default:"23h"`
-	S3Bucket                 string        `split_words:"true" required:"true"`
+	CacheResignBefore        time.Duration `split_words:"true" default:"1h"`
+	NegativeCacheTTL         time.Duration `split_words:"true" default:"1m"`
+	CacheBackend             string        `split_words:"true" default:"memory"`
+	CacheLocalTTL            time.Duration `split_words:"true" default:"1m"`
+	RedisURL                 string        `split_words:"true"`
+	StorageBackend           string        `split_words:"true" default:"s3"`
+	S3Bucket                 string        `split_words:"true"`
 	S3UseAccelerate          bool          `split_words:"true" default:"false"`
 	S3PresignEnabled         bool          `split_words:"true" default:"true"`
 	S3PresignExpiration      time.Duration `split_words:"true" default:"24h"`
+	S3Endpoint               string        `split_words:"true"`
+	S3ForcePathStyle         bool          `split_words:"true" default:"false"`
+	S3PublicBaseURL          string        `split_words:"true"`
+	S3StreamingEnabled       bool          `split_words:"true" default:"false"`
+	GCSBucket                string        `split_words:"true"`
+	GCSSignedURLExpiration   time.Duration `split_words:"true" default:"24h"`
+	GCSGoogleAccessID        string        `split_words:"true"`
+	GCSPrivateKeyFile        string        `split_words:"true"`
+	AzureContainer           string        `split_words:"true"`
+	AzureAccountName         string        `split_words:"true"`
+	AzureAccountKey          string        `split_words:"true"`
+	AzureServiceURL          string        `split_words:"true"`
+	AzureSASExpiration       time.Duration `split_words:"true" default:"24h"`
+	FSRoot                   string        `split_words:"true"`
+	ProxyBaseURL             string        `split_words:"true"`
+	ProxySigningKey          string        `split_words:"true"`
+	ProxyHrefExpiration      time.Duration `split_words:"true" default:"24h"`
+	FillQueueDir             string        `split_words:"true"`
+	FillQueueWorkers         int           `split_words:"true" default:"8"`
+	FillQueueMaxAttempts     int           `split_words:"true" default:"5"`
+	FillQueueInitialBackoff  time.Duration `split_words:"true" default:"5s"`
+	FillQueueMaxBackoff      time.Duration `split_words:"true" default:"5m"`
+	FillQueueDeadRetention   time.Duration `split_words:"true" default:"168h"`
+	FillLeaseEnabled         bool          `split_words:"true" default:"false"`
+	FillLeaseTTL             time.Duration `split_words:"true" default:"15m"`
+	TeeStreamingEnabled      bool          `split_words:"true" default:"false"`
+	LocksCacheTTL            time.Duration `split_words:"true"`
+	UploadEnabled            bool          `split_words:"true" default:"false"`
+	UploadMode               string        `split_words:"true" default:"async"`
+	UploadSpoolDir           string        `split_words:"true"`
+	UploadQueueDir           string        `split_words:"true"`
+	UploadQueueWorkers       int           `split_words:"true" default:"8"`
+	DiskCacheEnabled         bool          `split_words:"true" default:"false"`
+	DiskCachePath            string        `split_words:"true"`
+	DiskCacheMaxBytes        int64         `split_words:"true"`
 	EnablePrometheusExporter bool          `split_words:"true" default:"false"`
+	TracingEnabled           bool          `split_words:"true" default:"false"`
+	TracingSampleRatio       float64       `split_words:"true" default:"1"`
+	ShutdownReadinessDelay   time.Duration `split_words:"true" default:"5s"`
+	ShutdownDrainPeriod      time.Duration `split_words:"true" default:"30s"`
 }
 
 func GetConfig() (*Config, error) {
@@ -25,5 +76,9 @@ func GetConfig() (*Config, error) {
 		return nil, err
 	}
 
+	if proxyConfiguration.UpstreamBaseURL == "" && proxyConfiguration.RoutesFile == "" {
+		return nil, errors.New("either APP_UPSTREAM_BASE_URL or APP_ROUTES_FILE is required")
+	}
+
 	return &proxyConfiguration, nil
 }
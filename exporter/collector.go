@@ -13,6 +13,32 @@ type LFSProxyCollector struct {
 	CacheMiss metrics.Counter
 	S3Hits    metrics.Counter
 	S3Miss    metrics.Counter
+	// VerificationFailures counts objects not cached because their content didn't match their OID or size
+	VerificationFailures metrics.Counter
+	// DegradedResponses counts batches answered from the object store alone while upstream was down
+	DegradedResponses metrics.Counter
+	// FillQueue* report the queue cache fills run on
+	FillQueueEnqueued     metrics.Counter
+	FillQueueCompleted    metrics.Counter
+	FillQueueRetries      metrics.Counter
+	FillQueueDeadLettered metrics.Counter
+	FillQueueDepth        metrics.Gauge
+	// FillsInFlight reports the objects being downloaded from upstream into the object store
+	FillsInFlight metrics.Gauge
+	// BatchLatency observes how long batch requests take, by operation
+	BatchLatency metrics.Histogram
+	// UpstreamLatency observes how long upstream takes to answer LFS API requests
+	UpstreamLatency metrics.Histogram
+	// UpstreamResponses counts the answers of upstream by status code, "error" when it couldn't be reached
+	UpstreamResponses metrics.Counter
+	// StoreLatency observes object store checks, URL signing and uploads, by operation (head, presign, upload)
+	StoreLatency metrics.Histogram
+	// FilledBytes counts the bytes of the objects downloaded from upstream into the object store
+	FilledBytes metrics.Counter
+	// ServedBytes counts the size of the objects handed out with object store URLs, bandwidth upstream didn't serve
+	ServedBytes metrics.Counter
+	// UploadFailures counts the uploads that failed, by destination (store, upstream)
+	UploadFailures metrics.Counter
 }
 
 func NewCollector() *LFSProxyCollector {
@@ -37,6 +63,85 @@ func NewCollector() *LFSProxyCollector {
 			Name:      "s3_miss",
 			Help:      "S3 Cache Misses",
 		}, []string{}),
+		VerificationFailures: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "verification_failure",
+			Help:      "Objects Rejected By Content Verification",
+		}, []string{}),
+		DegradedResponses: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "degraded_response",
+			Help:      "Batches Served Without Upstream",
+		}, []string{}),
+		FillQueueEnqueued: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "fill_queue_enqueued",
+			Help:      "Cache Fills Queued",
+		}, []string{}),
+		FillQueueCompleted: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "fill_queue_completed",
+			Help:      "Cache Fills Completed",
+		}, []string{}),
+		FillQueueRetries: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "fill_queue_retry",
+			Help:      "Cache Fills Retried",
+		}, []string{}),
+		FillQueueDeadLettered: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "fill_queue_dead_letter",
+			Help:      "Cache Fills Dead-Lettered",
+		}, []string{}),
+		FillQueueDepth: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "lfsproxy",
+			Name:      "fill_queue_depth",
+			Help:      "Cache Fills Queued Or Running",
+		}, []string{}),
+		FillsInFlight: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "lfsproxy",
+			Name:      "fills_in_flight",
+			Help:      "Objects Being Downloaded From Upstream Into The Object Store",
+		}, []string{}),
+		BatchLatency: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "lfsproxy",
+			Name:      "batch_duration_seconds",
+			Help:      "Batch Request Latency",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{"operation"}),
+		UpstreamLatency: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "lfsproxy",
+			Name:      "upstream_duration_seconds",
+			Help:      "Upstream Request Latency",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{}),
+		UpstreamResponses: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "upstream_response",
+			Help:      "Upstream Responses By Status Code",
+		}, []string{"code"}),
+		StoreLatency: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "lfsproxy",
+			Name:      "store_duration_seconds",
+			Help:      "Object Store Operation Latency",
+			// Uploads of large objects take minutes where checks take milliseconds
+			Buckets: stdprometheus.ExponentialBuckets(0.001, 2, 18),
+		}, []string{"operation"}),
+		FilledBytes: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "filled_bytes",
+			Help:      "Bytes Filled From Upstream",
+		}, []string{}),
+		ServedBytes: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "served_bytes",
+			Help:      "Bytes Served By The Object Store",
+		}, []string{}),
+		UploadFailures: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "lfsproxy",
+			Name:      "upload_failure",
+			Help:      "Failed Uploads By Destination",
+		}, []string{"destination"}),
 	}
 }
 
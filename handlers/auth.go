@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errUnauthorized = errors.New("credentials not authorized by upstream")
+
+// authorize validates the caller credentials against upstream before serving objects from the cache.
+//
+// It sends upstream a batch request for a single object of the original request with the caller headers,
+// upstream answering 200 means the caller can read the repository. Decisions are cached per credential
+// and repository for APP_AUTH_CHECK_TTL
+func (l LFSHandler) authorize(c *gin.Context, up *upstream, batchRequest BatchRequest) (int, error) {
+	if statusCode, message, ok := l.cachedAuthDecision(c, up); ok {
+		return authDecision(statusCode, message)
+	}
+
+	checkRequest := BatchRequest{
+		Operation: batchRequest.Operation,
+		Transfers: batchRequest.Transfers,
+		Ref:       batchRequest.Ref,
+		HashAlgo:  batchRequest.HashAlgo,
+		Objects:   batchRequest.Objects[:1],
+	}
+
+	_, statusCode, err := l.getFromUpstream(c.Request.Context(), up.baseURL, checkRequest, up.path, c.Request.Header)
+	if err != nil && !isAuthStatus(statusCode) {
+		// Upstream failed for reasons unrelated to the caller, don't cache anything
+		return statusCode, err
+	}
+
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+
+	key := authCacheKey(up.baseURL, c.GetHeader("Authorization"))
+	if err := l.authCache.Set(key, []byte(strconv.Itoa(statusCode)+"\n"+message)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return authDecision(statusCode, message)
+}
+
+// cachedAuthDecision returns the upstream status code and error cached for the caller credentials, if any
+func (l LFSHandler) cachedAuthDecision(c *gin.Context, up *upstream) (int, string, bool) {
+	data, err := l.authCache.Get(authCacheKey(up.baseURL, c.GetHeader("Authorization")))
+	if err != nil {
+		return 0, "", false
+	}
+
+	// Entries are the upstream status code, followed by the upstream error on denials
+	code, message, _ := strings.Cut(string(data), "\n")
+	statusCode, err := strconv.Atoi(code)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return statusCode, message, true
+}
+
+func authDecision(statusCode int, message string) (int, error) {
+	if statusCode == http.StatusOK {
+		return statusCode, nil
+	}
+
+	if message == "" {
+		return statusCode, errUnauthorized
+	}
+
+	return statusCode, errors.New(message)
+}
+
+func isAuthStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden || statusCode == http.StatusNotFound
+}
+
+// authCacheKey never keeps the credential itself in memory, only its hash
+func authCacheKey(upstreamBaseURL string, authorization string) string {
+	sum := sha256.Sum256([]byte(upstreamBaseURL + "\n" + authorization))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// abortWithUpstreamError answers with upstream failures, formatting authorization failures
+// as LFS errors so git-lfs prompts for credentials
+func abortWithUpstreamError(c *gin.Context, statusCode int, err error) {
+	if statusCode == http.StatusUnauthorized {
+		c.Header("LFS-Authenticate", `Basic realm="Git LFS"`)
+	}
+
+	if isAuthStatus(statusCode) {
+		// Keep the upstream message when it already answered with an LFS error
+		var upstreamError ErrorResponse
+		if json.Unmarshal([]byte(err.Error()), &upstreamError) == nil && upstreamError.Message != "" {
+			abortWithLFSError(c, statusCode, upstreamError.Message)
+			return
+		}
+
+		abortWithLFSError(c, statusCode, http.StatusText(statusCode))
+		return
+	}
+
+	c.AbortWithError(statusCode, err) //nolint:errcheck
+}
+
+// abortWithLFSError answers with an LFS error payload
+//
+// https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md#response-errors
+func abortWithLFSError(c *gin.Context, statusCode int, message string) {
+	c.Header("Content-Type", "application/vnd.git-lfs+json")
+	c.AbortWithStatusJSON(statusCode, ErrorResponse{
+		Message: message,
+	})
+}
@@ -1,6 +1,17 @@
 package handlers
 
-import "time"
+import (
+	"regexp"
+	"time"
+)
+
+var oidPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// validOID reports whether oid is a SHA-256 oid. Oids end up in storage and cache keys,
+// anything else could reach the objects of another repository
+func validOID(oid string) bool {
+	return oidPattern.MatchString(oid)
+}
 
 type BatchRequest struct {
 	Operation string                 `json:"operation"`
@@ -24,6 +35,15 @@ type BatchObjectResponse struct {
 	Size          int64                                 `json:"size"`
 	Authenticated bool                                  `json:"authenticated,omitempty"`
 	Actions       map[string]*BatchObjectActionResponse `json:"actions,omitempty"`
+	Error         *BatchObjectError                     `json:"error,omitempty"`
+}
+
+// BatchObjectError is the error of a single object of a BatchResponse, such as a missing object
+//
+// https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md#response-errors
+type BatchObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 // BatchObjectActionResponse is the action item of a BatchObjectResponse
@@ -34,3 +54,12 @@ type BatchObjectActionResponse struct {
 	ExpiresIn int               `json:"expires_in,omitempty"`
 	ExpiresAt time.Time         `json:"expires_at,omitempty"`
 }
+
+// ErrorResponse is the payload of LFS API errors
+//
+// https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md#response-errors
+type ErrorResponse struct {
+	Message          string `json:"message"`
+	DocumentationURL string `json:"documentation_url,omitempty"`
+	RequestID        string `json:"request_id,omitempty"`
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isUpstreamOutage tells whether upstream failed for reasons unrelated to the request,
+// such as being unreachable or answering with a server error
+func isUpstreamOutage(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError
+}
+
+// degradedAuthorized tells whether a caller can be served while upstream is down. With the authorization check
+// enabled, only callers upstream authorized within APP_AUTH_CHECK_TTL are
+func (l LFSHandler) degradedAuthorized(c *gin.Context, up *upstream) bool {
+	if !l.config.AuthCheckEnabled {
+		return true
+	}
+
+	statusCode, _, ok := l.cachedAuthDecision(c, up)
+
+	return ok && statusCode == http.StatusOK
+}
+
+// serveDegraded answers a download batch upstream failed to answer with the objects held by the object store.
+// Objects missing from it get a per-object error, and the responses aren't cached so they don't outlive the outage
+func (l LFSHandler) serveDegraded(c *gin.Context, up *upstream, batchRequest BatchRequest, response *BatchResponse, upstreamErr error) {
+	ctx := c.Request.Context()
+	slog.WarnContext(ctx, "upstream unavailable, serving degraded batch", "upstream", up.baseURL, "objects", len(batchRequest.Objects), "error", upstreamErr)
+	l.promCollector.DegradedResponses.Add(1)
+
+	objects := make([]*BatchObjectResponse, len(batchRequest.Objects))
+
+	var wg sync.WaitGroup
+	for i, object := range batchRequest.Objects {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			objects[i] = l.degradedObject(ctx, up, object)
+		}()
+	}
+	wg.Wait()
+
+	response.Objects = append(response.Objects, objects...)
+	if response.Transfer == "" {
+		response.Transfer = "basic"
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (l LFSHandler) degradedObject(ctx context.Context, up *upstream, object *BatchObjectResponse) *BatchObjectResponse {
+	obj := &BatchObjectResponse{
+		OID:  object.OID,
+		Size: object.Size,
+	}
+
+	exists, err := l.objectExists(ctx, up, object.OID)
+	if err != nil {
+		slog.ErrorContext(ctx, "error checking object", "oid", object.OID, "error", err)
+	}
+
+	if err == nil && exists {
+		download := &BatchObjectActionResponse{}
+		if err := l.signDownload(ctx, up, object.OID, download); err == nil {
+			setExpiresIn(download)
+			obj.Actions = map[string]*BatchObjectActionResponse{"download": download}
+			l.promCollector.ServedBytes.Add(float64(obj.Size))
+			return obj
+		}
+		slog.ErrorContext(ctx, "error signing download", "oid", object.OID, "error", err)
+	}
+
+	obj.Error = &BatchObjectError{
+		Code:    http.StatusServiceUnavailable,
+		Message: "Object not available while upstream is unreachable",
+	}
+
+	return obj
+}
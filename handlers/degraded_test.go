@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/config"
+)
+
+func TestDegradedMode(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL:     "https://fake-git-server.com/repository.git/",
+		DegradedModeEnabled: true,
+	}
+
+	cache := NewMockCache()
+	authCache := NewMockCache()
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		authCache:     authCache,
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        cfg,
+		objectStore: MockObjectStore{
+			urls:         map[string]string{testNamespace + testOID("stored"): "https://this-is-from-s3.com"},
+			uploadCalled: &atomic.Bool{},
+		},
+	}
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	upstreamStatus := http.StatusServiceUnavailable
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/objects/batch",
+		func(req *http.Request) (*http.Response, error) {
+			return httpmock.NewStringResponse(upstreamStatus, "unavailable"), nil
+		},
+	)
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+
+	batch := func(authorization string, oids ...string) (*httptest.ResponseRecorder, map[string]*BatchObjectResponse) {
+		objects := []string{}
+		for _, oid := range oids {
+			objects = append(objects, `{"oid":"`+oid+`","size":123}`)
+		}
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:9999/objects/batch", bytes.NewBufferString(`{"operation":"download","objects":[`+strings.Join(objects, ",")+`]}`))
+		req.Header.Set("Authorization", authorization)
+		r.ServeHTTP(w, req)
+
+		byOID := map[string]*BatchObjectResponse{}
+		if w.Code == 200 {
+			var batchResponse BatchResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batchResponse))
+			for _, obj := range batchResponse.Objects {
+				byOID[obj.OID] = obj
+			}
+		}
+
+		return w, byOID
+	}
+
+	t.Run("it should serve stored objects while upstream is down", func(t *testing.T) {
+		defer cache.Reset()
+
+		require.NoError(t, cache.Set(testNamespace+testOID("cached"), []byte(`{"oid":"`+testOID("cached")+`","size":123,"actions":{"download":{"href":"https://cached-download.com"}}}`)))
+
+		w, objects := batch("Basic allowed", testOID("cached"), testOID("stored"), testOID("missing"))
+		require.Equal(t, 200, w.Code)
+		require.Len(t, objects, 3)
+
+		assert.Equal(t, "https://cached-download.com", objects[testOID("cached")].Actions["download"].Href)
+		assert.Equal(t, "https://this-is-from-s3.com", objects[testOID("stored")].Actions["download"].Href)
+		assert.Nil(t, objects[testOID("stored")].Error)
+		assert.Equal(t, http.StatusServiceUnavailable, objects[testOID("missing")].Error.Code)
+
+		// Degraded responses aren't cached
+		assert.False(t, cache.Has(testNamespace+testOID("stored")))
+	})
+
+	t.Run("it should pass errors unrelated to an outage through", func(t *testing.T) {
+		upstreamStatus = http.StatusUnauthorized
+		defer func() { upstreamStatus = http.StatusServiceUnavailable }()
+
+		w, _ := batch("Basic allowed", testOID("stored"))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("it should fail when disabled", func(t *testing.T) {
+		cfg.DegradedModeEnabled = false
+		defer func() { cfg.DegradedModeEnabled = true }()
+
+		w, _ := batch("Basic allowed", testOID("stored"))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("it should only serve callers recently authorized by upstream when checking credentials", func(t *testing.T) {
+		cfg.AuthCheckEnabled = true
+		defer func() { cfg.AuthCheckEnabled = false }()
+		defer authCache.Reset()
+
+		w, _ := batch("Basic allowed", testOID("stored"))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		require.NoError(t, authCache.Set(authCacheKey(cfg.UpstreamBaseURL, "Basic allowed"), []byte("200\n")))
+
+		w, objects := batch("Basic allowed", testOID("stored"))
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "https://this-is-from-s3.com", objects[testOID("stored")].Actions["download"].Href)
+	})
+	t.Run("it should reject oids escaping the namespace of the repository", func(t *testing.T) {
+		w, _ := batch("Basic allowed", "../secret.git/"+testOID("stored"))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.NotContains(t, w.Body.String(), "https://")
+	})
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vela-games/lfsproxy/logging"
+	"github.com/vela-games/lfsproxy/queue"
+	"github.com/vela-games/lfsproxy/services"
+	"github.com/vela-games/lfsproxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// errFillLeased is returned while another replica holds the lease of an object, the fill is retried until it's stored
+var errFillLeased = errors.New("object is being filled by another replica")
+
+// fillGroup coalesces concurrent fills of the same object like a singleflight.Group,
+// and tells which fills are running to callers that would rather not wait for them
+type fillGroup struct {
+	group singleflight.Group
+
+	mu      sync.Mutex
+	running map[string]struct{}
+}
+
+// Do runs fn once for all the concurrent calls with the same key, see singleflight.Group.Do
+func (g *fillGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error, bool) {
+	return g.group.Do(key, func() (interface{}, error) {
+		g.mu.Lock()
+		if g.running == nil {
+			g.running = map[string]struct{}{}
+		}
+		g.running[key] = struct{}{}
+		g.mu.Unlock()
+
+		defer func() {
+			g.mu.Lock()
+			delete(g.running, key)
+			g.mu.Unlock()
+		}()
+
+		return fn()
+	})
+}
+
+// Running tells whether a fill of key is in progress
+func (g *fillGroup) Running(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.running[key]
+	return ok
+}
+
+// fillJob is a cache fill waiting on the fill queue
+type fillJob struct {
+	UpstreamBaseURL string              `json:"upstream_base_url"`
+	Bucket          string              `json:"bucket,omitempty"`
+	KeyPrefix       string              `json:"key_prefix,omitempty"`
+	Object          BatchObjectResponse `json:"object"`
+	// Trace is the trace context of the request the fill was queued by, the trace of the fill links back to it
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// newFillQueue builds the queue cache fills run on. Fills are kept on APP_FILL_QUEUE_DIR when set so they survive restarts,
+// along with the headers of their upstream download action, which may hold credentials
+func (l *LFSHandler) newFillQueue() (*queue.Queue, error) {
+	return queue.New(queue.Options{
+		Dir:            l.config.FillQueueDir,
+		Workers:        l.config.FillQueueWorkers,
+		MaxAttempts:    l.config.FillQueueMaxAttempts,
+		InitialBackoff: l.config.FillQueueInitialBackoff,
+		MaxBackoff:     l.config.FillQueueMaxBackoff,
+		DeadRetention:  l.config.FillQueueDeadRetention,
+		Metrics: queue.Metrics{
+			Enqueued:     l.promCollector.FillQueueEnqueued,
+			Completed:    l.promCollector.FillQueueCompleted,
+			Retried:      l.promCollector.FillQueueRetries,
+			DeadLettered: l.promCollector.FillQueueDeadLettered,
+			Depth:        l.promCollector.FillQueueDepth,
+		},
+	}, func(ctx context.Context, job *queue.Job) error {
+		return l.runFillJob(ctx, job)
+	})
+}
+
+// enqueueFill queues the download of an object missing from the object store
+func (l LFSHandler) enqueueFill(ctx context.Context, up *upstream, obj BatchObjectResponse) {
+	job := fillJob{
+		UpstreamBaseURL: up.baseURL,
+		Bucket:          up.bucket,
+		KeyPrefix:       up.keyPrefix,
+		Object:          obj,
+		Trace:           tracing.Carrier(ctx),
+	}
+
+	if err := l.fillQueue.Enqueue(ctx, up.cacheKey(obj.OID), job); errors.Is(err, queue.ErrClosed) {
+		slog.WarnContext(ctx, "not queueing fill while shutting down", "oid", obj.OID)
+	} else if err != nil {
+		slog.ErrorContext(ctx, "error queueing fill", "oid", obj.OID, "error", err)
+	}
+}
+
+func (l LFSHandler) runFillJob(ctx context.Context, job *queue.Job) (err error) {
+	var fill fillJob
+	if err := json.Unmarshal(job.Payload, &fill); err != nil {
+		return queue.Permanent(err)
+	}
+
+	download, ok := fill.Object.Actions["download"]
+	if !ok {
+		return queue.Permanent(errors.New("no download action"))
+	}
+
+	// The upstream href can't be renewed without the credentials of the client, so retrying an expired href is pointless
+	if (job.Attempts > 0 || job.Deferrals > 0) && !download.ExpiresAt.IsZero() && time.Now().After(download.ExpiresAt) {
+		return queue.Permanent(fmt.Errorf("download href of %v expired", fill.Object.OID))
+	}
+
+	ctx = logging.With(logging.WithRequestID(ctx, job.RequestID), slog.String("operation", "fill"))
+	ctx, span := tracing.Link(ctx, "fill", fill.Trace, trace.WithAttributes(tracing.OID(fill.Object.OID), attribute.Int("lfs.attempt", job.Attempts+1)))
+	defer func() { tracing.End(span, err) }()
+
+	up := l.newUpstream(fill.UpstreamBaseURL, fill.Bucket, fill.KeyPrefix, "")
+
+	// Retried fills may have been completed by the replica holding the lease in the meantime
+	if job.Attempts > 0 || job.Deferrals > 0 {
+		if exists, err := l.objectExists(ctx, up, fill.Object.OID); err == nil && exists {
+			return nil
+		}
+	}
+
+	// Waiting for another replica isn't a failure of the fill
+	err = l.fill(ctx, up, fill.Object)
+	if errors.Is(err, errFillLeased) {
+		return queue.Defer(err)
+	}
+
+	return err
+}
+
+// leaseFill acquires the lease of an object about to be filled when APP_FILL_LEASE_ENABLED is set, failing with
+// errFillLeased while another replica holds it. The lease is renewed until the returned func releases it,
+// so fills taking longer than APP_FILL_LEASE_TTL aren't taken over
+func (l LFSHandler) leaseFill(ctx context.Context, up *upstream, oid string) (func(), error) {
+	if !l.config.FillLeaseEnabled {
+		return func() {}, nil
+	}
+
+	acquired, err := services.AcquireLease(up.objectStore, oid, l.config.FillLeaseTTL)
+	if err != nil {
+		slog.WarnContext(ctx, "error acquiring lease, filling anyway", "oid", oid, "error", err)
+		return func() {}, nil
+	} else if !acquired {
+		return nil, errFillLeased
+	}
+
+	// lost is only read once the renewals stopped
+	lost := false
+	done := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+
+		ticker := time.NewTicker(l.config.FillLeaseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			// The fill goes on without the lease, objects are content-addressed so a concurrent fill stores the same content
+			if held, err := services.RenewLease(up.objectStore, oid, l.config.FillLeaseTTL); err != nil {
+				slog.WarnContext(ctx, "error renewing lease", "oid", oid, "error", err)
+			} else if !held {
+				slog.WarnContext(ctx, "lease lost while filling", "oid", oid)
+				lost = true
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-renewed
+
+		// Lost leases may be held by another replica by now
+		if lost {
+			return
+		}
+
+		if err := services.ReleaseLease(up.objectStore, oid); err != nil {
+			slog.ErrorContext(ctx, "error releasing lease", "oid", oid, "error", err)
+		}
+	}, nil
+}
+
+// fill downloads an object from upstream into the object store. Concurrent fills of the same object are coalesced
+// within the process, and across replicas with a lease on the object store when APP_FILL_LEASE_ENABLED is set
+func (l LFSHandler) fill(ctx context.Context, up *upstream, obj BatchObjectResponse) error {
+	_, err, _ := l.fills.Do(up.cacheKey(obj.OID), func() (interface{}, error) {
+		release, err := l.leaseFill(ctx, up, obj.OID)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		l.promCollector.FillsInFlight.Add(1)
+		defer l.promCollector.FillsInFlight.Add(-1)
+
+		download := obj.Actions["download"]
+
+		req, err := http.NewRequestWithContext(ctx, "GET", download.Href, nil)
+		if err != nil {
+			return nil, queue.Permanent(err)
+		}
+
+		for key, value := range download.Header {
+			req.Header.Set(key, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+
+			err := fmt.Errorf("error downloading %v from upstream: %v", obj.OID, resp.Status)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				return nil, queue.Permanent(err)
+			}
+
+			return nil, err
+		}
+
+		err = l.pushToS3(ctx, up, obj, services.NewVerifyingReader(resp.Body, obj.OID, obj.Size))
+		// Upstream serves the same content on every attempt
+		if errors.Is(err, services.ErrContentMismatch) {
+			return nil, queue.Permanent(err)
+		}
+
+		return nil, err
+	})
+
+	return err
+}
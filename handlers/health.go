@@ -1,11 +1,40 @@
 package handlers
 
-import "github.com/gin-gonic/gin"
+import (
+	"sync/atomic"
 
-type HealthHandler struct{}
+	"github.com/gin-gonic/gin"
+)
+
+type HealthHandler struct {
+	draining *atomic.Bool
+}
+
+func NewHealthHandler() HealthHandler {
+	return HealthHandler{
+		draining: &atomic.Bool{},
+	}
+}
 
 func (h HealthHandler) Get(c *gin.Context) {
 	c.AbortWithStatusJSON(200, gin.H{
 		"health": "ok",
 	})
 }
+
+// Ready reports the proxy unready once it starts draining so no new requests are routed to it
+func (h HealthHandler) Ready(c *gin.Context) {
+	if h.draining.Load() {
+		c.AbortWithStatusJSON(503, gin.H{
+			"health": "draining",
+		})
+		return
+	}
+
+	h.Get(c)
+}
+
+// Drain marks the proxy as shutting down
+func (h HealthHandler) Drain() {
+	h.draining.Store(true)
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	healthHandler := NewHealthHandler()
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.GET("/health", healthHandler.Get)
+	r.GET("/ready", healthHandler.Ready)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 200, get("/health").Code)
+	assert.Equal(t, 200, get("/ready").Code)
+
+	healthHandler.Drain()
+
+	w := get("/ready")
+	assert.Equal(t, 503, w.Code)
+	assert.JSONEq(t, `{"health":"draining"}`, w.Body.String())
+	assert.Equal(t, 200, get("/health").Code)
+}
@@ -6,47 +6,272 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/allegro/bigcache/v3"
 	"github.com/gin-gonic/gin"
 	"github.com/vela-games/lfsproxy/cache"
 	"github.com/vela-games/lfsproxy/config"
 	"github.com/vela-games/lfsproxy/exporter"
+	"github.com/vela-games/lfsproxy/logging"
+	"github.com/vela-games/lfsproxy/queue"
+	"github.com/vela-games/lfsproxy/routing"
 	"github.com/vela-games/lfsproxy/services"
+	"github.com/vela-games/lfsproxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type LFSHandler struct {
-	cache         cache.Cache
+	cache cache.Cache
+	// authCache holds the upstream authorization decisions of each credential, see authorize
+	authCache cache.Cache
+	// locksCache holds lock listings of upstream, see ProxyLocks
+	locksCache cache.Cache
+	// negativeCache holds the errors of objects upstream reported missing, see cacheObjectError
+	negativeCache cache.Cache
+	// fills coalesces concurrent fills of the same object, see fill
+	fills     *fillGroup
+	fillQueue *queue.Queue
+	// uploadQueue completes uploads on upstream in the background, see APP_UPLOAD_MODE
+	uploadQueue   *queue.Queue
 	promCollector *exporter.LFSProxyCollector
-	awsService    services.AWSService
-	config        *config.Config
+	objectStore   services.ObjectStore
+	// bucketStores holds the object stores of the buckets overridden by routes
+	bucketStores map[string]services.ObjectStore
+	routes       *routing.Table
+	signer       *services.HrefSigner
+	config       *config.Config
+}
+
+// upstream is the upstream LFS server and the object store a request is proxied to
+type upstream struct {
+	baseURL     string
+	bucket      string
+	keyPrefix   string
+	objectStore services.ObjectStore
+	// path is the LFS API path requested, relative to the upstream base url
+	path string
+	// cachePrefix scopes in-memory cache keys the same way objectStore scopes storage keys
+	cachePrefix string
+}
+
+func (u upstream) cacheKey(oid string) string {
+	if u.cachePrefix == "" {
+		return oid
+	}
+
+	return u.cachePrefix + "/" + oid
 }
 
 func NewLFSHandler(ctx context.Context, cfg *config.Config) (*LFSHandler, error) {
-	cache, err := cache.NewCache(ctx, cfg.CacheEviction)
+	caches, err := cache.NewBuilder(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	awsService, err := services.NewAWSService(cfg.S3Bucket, cfg.S3UseAccelerate, cfg.S3PresignEnabled, cfg.S3PresignExpiration)
+	var authCache cache.Cache
+	if cfg.AuthCheckEnabled {
+		if authCache, err = caches.New(ctx, "auth", cfg.AuthCheckTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	var locksCache cache.Cache
+	if cfg.LocksCacheTTL > 0 {
+		if locksCache, err = caches.New(ctx, "locks", cfg.LocksCacheTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	var negativeCache cache.Cache
+	if cfg.NegativeCacheTTL > 0 {
+		if negativeCache, err = caches.New(ctx, "missing", cfg.NegativeCacheTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	var routes *routing.Table
+	var buckets []string
+	if cfg.RoutesFile != "" {
+		if routes, err = routing.LoadTable(cfg.RoutesFile); err != nil {
+			return nil, err
+		}
+		buckets = routes.Buckets()
+	}
+
+	stores, err := services.NewObjectStores(cfg, buckets)
 	if err != nil {
 		return nil, err
 	}
 
-	return &LFSHandler{
-		cache:         cache,
+	objectStore := stores[""]
+	delete(stores, "")
+
+	objectCache, err := caches.New(ctx, "objects", objectCacheTTL(cfg, objectStore.URLExpiration()))
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.UploadEnabled && cfg.UploadMode != UploadModeSync && cfg.UploadMode != UploadModeAsync {
+		return nil, fmt.Errorf("unknown upload mode %q", cfg.UploadMode)
+	}
+
+	// The signer is only needed when objects are served or uploads are received by the proxy itself
+	var signer *services.HrefSigner
+	if _, ok := objectStore.(services.ObjectOpener); ok || cfg.UploadEnabled || cfg.TeeStreamingEnabled {
+		if signer, err = services.NewHrefSignerFromConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	handler := &LFSHandler{
+		cache:         objectCache,
+		authCache:     authCache,
+		locksCache:    locksCache,
+		negativeCache: negativeCache,
+		fills:         &fillGroup{},
 		promCollector: exporter.NewCollector(),
 		config:        cfg,
-		awsService:    awsService,
-	}, nil
+		objectStore:   objectStore,
+		bucketStores:  stores,
+		routes:        routes,
+		signer:        signer,
+	}
+
+	if cfg.FillLeaseEnabled && !services.SupportsLeases(objectStore) {
+		slog.WarnContext(ctx, "APP_FILL_LEASE_ENABLED has no effect, the storage backend can't hold leases", "backend", cfg.StorageBackend)
+	}
+
+	if handler.fillQueue, err = handler.newFillQueue(); err != nil {
+		return nil, err
+	}
+	// Fills outlive the signal context, they are stopped by Drain
+	go handler.fillQueue.Run(context.Background())
+
+	if cfg.UploadEnabled {
+		if handler.uploadQueue, err = handler.newUploadQueue(); err != nil {
+			return nil, err
+		}
+		go handler.uploadQueue.Run(context.Background())
+	}
+
+	return handler, nil
+}
+
+// objectCacheTTL keeps cached batch responses at least until the URLs they hand out expire when they are
+// re-signed, see refreshCachedDownload. Otherwise they don't outlive their URLs, with the same one hour
+// in a day margin as the default APP_CACHE_EVICTION has on the default URL expirations
+func objectCacheTTL(cfg *config.Config, expiration time.Duration) time.Duration {
+	if expiration <= 0 {
+		return cfg.CacheEviction
+	}
+
+	if cfg.CacheResignBefore > 0 {
+		return max(cfg.CacheEviction, expiration)
+	}
+
+	if ttl := expiration - expiration/24; ttl < cfg.CacheEviction {
+		return ttl
+	}
+
+	return cfg.CacheEviction
+}
+
+// Drain stops queueing cache fills and background uploads and waits for the running ones to complete.
+// Fills and uploads still running when ctx is done are aborted and left queued for the next run
+func (l LFSHandler) Drain(ctx context.Context) error {
+	queues := []*queue.Queue{l.fillQueue}
+	if l.uploadQueue != nil {
+		queues = append(queues, l.uploadQueue)
+	}
+
+	// Neither queue starts new jobs while the other one drains
+	for _, q := range queues {
+		q.Close()
+	}
+
+	var err error
+	for _, q := range queues {
+		err = errors.Join(err, q.Drain(ctx))
+	}
+
+	return err
+}
+
+// resolveUpstream finds where to proxy a request to. Requests on /:owner/:repo/info/lfs/ are routed
+// with the routing table, any other request goes to APP_UPSTREAM_BASE_URL
+func (l LFSHandler) resolveUpstream(c *gin.Context) (*upstream, int, error) {
+	owner, repo := c.Param("owner"), c.Param("repo")
+
+	if owner == "" {
+		if l.config.UpstreamBaseURL == "" {
+			return nil, http.StatusNotFound, routing.ErrNoRoute
+		}
+
+		return l.newUpstream(l.config.UpstreamBaseURL, "", "", c.Request.URL.Path), 0, nil
+	}
+
+	if l.routes == nil {
+		return nil, http.StatusNotFound, routing.ErrNoRoute
+	}
+
+	route, err := l.routes.Resolve(owner, repo)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	lfsPath := strings.TrimPrefix(c.Request.URL.Path, "/"+route.Repository+"/info/lfs")
+
+	return l.newUpstream(route.UpstreamBaseURL, route.Bucket, route.KeyPrefix, lfsPath), 0, nil
+}
+
+// newUpstream scopes the storage and cache keys of an upstream to its repository so objects
+// are never served to clients of another repository, unless cross-repository dedupe is enabled
+func (l LFSHandler) newUpstream(baseURL string, bucket string, keyPrefix string, lfsPath string) *upstream {
+	store := l.objectStore
+	if bucket != "" {
+		store = l.bucketStores[bucket]
+	}
+
+	prefix := keyPrefix
+	if !l.config.CrossRepositoryDedupe {
+		prefix = path.Join(keyPrefix, routing.Namespace(baseURL))
+	}
+
+	if prefix != "" {
+		store = services.NewPrefixedStore(store, prefix)
+	}
+
+	cachePrefix := prefix
+	if bucket != "" {
+		cachePrefix = bucket + ":" + prefix
+	}
+
+	return &upstream{
+		baseURL:     baseURL,
+		bucket:      bucket,
+		keyPrefix:   keyPrefix,
+		objectStore: store,
+		path:        lfsPath,
+		cachePrefix: cachePrefix,
+	}
 }
 
 func (l LFSHandler) PostBatch(c *gin.Context) {
+	up, statusCode, err := l.resolveUpstream(c)
+	if err != nil {
+		c.AbortWithError(statusCode, err) //nolint:errcheck
+		return
+	}
+
 	// Parse LFS Batch Request to Struct
 	var batchRequest BatchRequest
 	if err := c.ShouldBindJSON(&batchRequest); err != nil {
@@ -54,6 +279,32 @@ func (l LFSHandler) PostBatch(c *gin.Context) {
 		return
 	}
 
+	for _, object := range batchRequest.Objects {
+		if !validOID(object.OID) {
+			abortWithLFSError(c, http.StatusUnprocessableEntity, "invalid oid "+strconv.Quote(object.OID))
+			return
+		}
+	}
+
+	ctx := logging.With(c.Request.Context(), slog.String("operation", batchRequest.Operation))
+	c.Request = c.Request.WithContext(ctx)
+
+	// Anything but uploads is served as a download, which also keeps the label values bounded
+	operation := "download"
+	if batchRequest.Operation == "upload" {
+		operation = "upload"
+	}
+
+	start := time.Now()
+	defer func() {
+		l.promCollector.BatchLatency.With("operation", operation).Observe(time.Since(start).Seconds())
+	}()
+
+	if batchRequest.Operation == "upload" {
+		l.postUploadBatch(c, up, batchRequest)
+		return
+	}
+
 	// Create Modified Batch Request that will only contain objects to be requested to upstream
 	// These would be the ones not cached in memory
 	modifiedBatchRequest := BatchRequest{
@@ -72,29 +323,50 @@ func (l LFSHandler) PostBatch(c *gin.Context) {
 	// Check if any of the objects being requested is cached in-memory
 	// If they are then don't include them on the modified batch request and add them to the final batch response
 	for _, object := range batchRequest.Objects {
-		data, err := l.cache.Get(object.OID)
+		data, err := cacheGet(ctx, l.cache, "objects", up.cacheKey(object.OID))
 		if err == nil {
 			l.promCollector.CacheHits.Add(1)
 			var cachedBatchObjectResponse BatchObjectResponse
 			if err := json.Unmarshal(data, &cachedBatchObjectResponse); err == nil {
+				l.refreshCachedDownload(ctx, up, &cachedBatchObjectResponse)
+				l.promCollector.ServedBytes.Add(float64(cachedBatchObjectResponse.Size))
 				if l.config.S3PresignEnabled {
-					go l.checkCachedLink(object.OID, cachedBatchObjectResponse.Actions["download"].HeadHref)
+					go l.checkCachedLink(context.WithoutCancel(ctx), up.cacheKey(object.OID), cachedBatchObjectResponse.Actions["download"].HeadHref)
 				}
 				finalBatchResponse.Objects = append(finalBatchResponse.Objects, &cachedBatchObjectResponse)
 				continue
 			}
-		} else if errors.Is(err, bigcache.ErrEntryNotFound) {
+		} else if errors.Is(err, cache.ErrEntryNotFound) {
 			l.promCollector.CacheMiss.Add(1)
 		}
 
+		if missing := l.cachedObjectError(ctx, up, object); missing != nil {
+			finalBatchResponse.Objects = append(finalBatchResponse.Objects, missing)
+			continue
+		}
+
 		modifiedBatchRequest.Objects = append(modifiedBatchRequest.Objects, object)
 	}
 
+	// Every object was cached so upstream won't see this request, make sure the caller is allowed to get them
+	if len(modifiedBatchRequest.Objects) == 0 && len(batchRequest.Objects) > 0 && l.config.AuthCheckEnabled {
+		statusCode, err := l.authorize(c, up, batchRequest)
+		if err != nil {
+			abortWithUpstreamError(c, statusCode, err)
+			return
+		}
+	}
+
 	// If we have objects to request to github because they were not cached
 	if len(modifiedBatchRequest.Objects) > 0 {
-		upstreamBatchResponse, statusCode, err := l.getFromUpstream(c, modifiedBatchRequest, c.Request.URL.Path, c.Request.Header)
+		upstreamBatchResponse, statusCode, err := l.getFromUpstream(ctx, up.baseURL, modifiedBatchRequest, up.path, c.Request.Header)
 		if err != nil {
-			c.AbortWithError(statusCode, err) //nolint:errcheck
+			if l.config.DegradedModeEnabled && isUpstreamOutage(statusCode) && l.degradedAuthorized(c, up) {
+				l.serveDegraded(c, up, modifiedBatchRequest, &finalBatchResponse, err)
+				return
+			}
+
+			abortWithUpstreamError(c, statusCode, err)
 			return
 		}
 
@@ -107,35 +379,60 @@ func (l LFSHandler) PostBatch(c *gin.Context) {
 		// For each of the objects returned by upstream
 		// check if we have them on S3, if not return the upstream url
 		for _, obj := range upstreamBatchResponse.Objects {
+			// Objects upstream answers with an oid of its own never reach a storage or cache key
+			if !validOID(obj.OID) {
+				finalBatchResponse.Objects = append(finalBatchResponse.Objects, obj)
+				totalUrls--
+				continue
+			}
+
 			_, ok := obj.Actions["download"]
 			if !ok {
+				// Objects uploaded to the proxy may still be on their way to upstream
+				if uploaded := l.uploadedObject(ctx, up, obj); uploaded != nil {
+					finalBatchResponse.Objects = append(finalBatchResponse.Objects, uploaded)
+					totalUrls--
+					continue
+				}
+
+				// Objects upstream can't serve are passed through with their error
+				l.cacheObjectError(ctx, up, obj)
+				finalBatchResponse.Objects = append(finalBatchResponse.Objects, obj)
 				totalUrls--
 				continue
 			}
 
 			obj := obj
 
-			go l.pullS3(*obj, urls)
+			go l.pullS3(ctx, up, *obj, urls)
 		}
 
-		count := 0
-		for r := range urls {
-			r := r
+		for count := 0; count < totalUrls; count++ {
+			r := <-urls
 			finalBatchResponse.Objects = append(finalBatchResponse.Objects, &r)
-			count++
-
-			if count >= totalUrls {
-				close(urls)
-				break
-			}
 		}
 	}
 
+	// Objects are served with the basic transfer adapter, which resumes interrupted downloads with Range requests
+	if finalBatchResponse.Transfer == "" {
+		finalBatchResponse.Transfer = "basic"
+	}
+
 	c.JSON(200, finalBatchResponse)
 }
 
-func (l LFSHandler) getFromUpstream(ctx context.Context, batchRequest BatchRequest, urlPath string, headers http.Header) (*BatchResponse, int, error) {
-	upstreamURL, err := url.Parse(l.config.UpstreamBaseURL)
+func (l LFSHandler) getFromUpstream(ctx context.Context, upstreamBaseURL string, batchRequest BatchRequest, urlPath string, headers http.Header) (_ *BatchResponse, statusCode int, err error) {
+	ctx, span := tracing.Start(ctx, "upstream.batch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("lfs.upstream", upstreamBaseURL),
+		attribute.String("lfs.operation", batchRequest.Operation),
+		attribute.Int("lfs.objects", len(batchRequest.Objects)),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+		tracing.End(span, err)
+	}()
+
+	upstreamURL, err := url.Parse(upstreamBaseURL)
 	if err != nil {
 		return nil, 500, err
 	}
@@ -149,25 +446,27 @@ func (l LFSHandler) getFromUpstream(ctx context.Context, batchRequest BatchReque
 	// Create new reverse proxy request
 	req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL.Path+strings.TrimLeft(urlPath, "/"), &buf)
 	if err != nil {
-		log.Printf("unexpected error creating request %v\n", err.Error())
+		slog.ErrorContext(ctx, "error creating upstream request", "error", err)
 		return nil, 500, err
 	}
 
-	req.Header = headers
+	// Upstream continues the trace of the proxy rather than the one of the client
+	req.Header = headers.Clone()
+	tracing.Inject(ctx, req.Header)
 	req.Host = upstreamURL.Host
 	req.URL.Scheme = upstreamURL.Scheme
 	req.URL.Host = upstreamURL.Host
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := l.doUpstream(req)
 	if err != nil {
-		log.Printf("unexpected error from upstream %v\n", err.Error())
+		slog.ErrorContext(ctx, "error requesting upstream", "upstream", upstreamBaseURL, "error", err)
 		return nil, 500, err
 	}
 
 	if !resp.Uncompressed && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
 		var err error
 		if resp.Body, err = gzip.NewReader(resp.Body); err != nil {
-			log.Printf("unexpected error uncompressing response %v\n", err.Error())
+			slog.ErrorContext(ctx, "error uncompressing upstream response", "upstream", upstreamBaseURL, "error", err)
 			return nil, 500, err
 		}
 	}
@@ -186,7 +485,7 @@ func (l LFSHandler) getFromUpstream(ctx context.Context, batchRequest BatchReque
 	return &upstreamBatchResponse, resp.StatusCode, nil
 }
 
-func (l LFSHandler) pullS3(obj BatchObjectResponse, urls chan<- BatchObjectResponse) {
+func (l LFSHandler) pullS3(ctx context.Context, up *upstream, obj BatchObjectResponse, urls chan<- BatchObjectResponse) {
 	batchResp := BatchObjectResponse{
 		OID:           obj.OID,
 		Size:          obj.Size,
@@ -195,79 +494,284 @@ func (l LFSHandler) pullS3(obj BatchObjectResponse, urls chan<- BatchObjectRespo
 	}
 	objectAction := obj.Actions["download"]
 
-	exists, err := l.awsService.OIDExists(obj.OID)
+	exists, err := l.objectExists(ctx, up, obj.OID)
 	if err != nil {
-		log.Printf("error: %v\n", err.Error())
+		slog.ErrorContext(ctx, "error checking object", "oid", obj.OID, "error", err)
 		urls <- batchResp
 		return
 	}
 
 	if exists {
-		url, headUrl, err := l.awsService.GetOIDPreSignedURL(obj.OID)
-		if err != nil {
-			log.Printf("error presigned: %v\n", err.Error())
+		if err := l.signDownload(ctx, up, obj.OID, objectAction); err != nil {
+			slog.ErrorContext(ctx, "error signing download", "oid", obj.OID, "error", err)
 			urls <- batchResp
 			return
 		}
 
-		objectAction.Href = url
-		objectAction.HeadHref = headUrl
-
 		batchResp.Actions["download"] = objectAction
-		if err := l.cacheObjResponse(obj.OID, batchResp); err != nil {
-			log.Printf("error caching response %v\n", err.Error())
+		if err := l.cacheObjResponse(up.cacheKey(obj.OID), batchResp); err != nil {
+			slog.ErrorContext(ctx, "error caching response", "oid", obj.OID, "error", err)
 		}
+		setExpiresIn(objectAction)
 
 		l.promCollector.S3Hits.Add(1)
-	} else {
-		resp, err := http.Get(batchResp.Actions["download"].Href)
-		if err == nil && resp.StatusCode == 200 {
-			go l.pushToS3(obj, resp.Body)
+		l.promCollector.ServedBytes.Add(float64(obj.Size))
+	} else if l.config.TeeStreamingEnabled {
+		// The fill happens when the client downloads the object through the proxy
+		l.promCollector.S3Miss.Add(1)
+
+		download, err := l.interceptDownload(up, obj)
+		if err != nil {
+			slog.ErrorContext(ctx, "error intercepting download, filling it in the background", "oid", obj.OID, "error", err)
+			l.enqueueFill(ctx, up, obj)
+			urls <- batchResp
+			return
 		}
+
+		batchResp.Actions = map[string]*BatchObjectActionResponse{"download": download}
+	} else {
+		l.enqueueFill(ctx, up, obj)
 		l.promCollector.S3Miss.Add(1)
 	}
 	urls <- batchResp
 }
 
-func (l LFSHandler) pushToS3(obj BatchObjectResponse, body io.ReadCloser) {
-	err := l.awsService.UploadOID(obj.OID, body)
+func (l LFSHandler) pushToS3(ctx context.Context, up *upstream, obj BatchObjectResponse, body io.ReadCloser) error {
+	err := l.storeObject(ctx, up, obj.OID, obj.Size, body)
 	if err != nil {
-		log.Printf("error uploading to S3: %v\n", err.Error())
+		if errors.Is(err, services.ErrContentMismatch) {
+			l.promCollector.VerificationFailures.Add(1)
+		}
+		slog.ErrorContext(ctx, "error storing object", "oid", obj.OID, "error", err)
+		return err
+	}
+	l.promCollector.FilledBytes.Add(float64(obj.Size))
+
+	download := &BatchObjectActionResponse{Header: obj.Actions["download"].Header}
+	if err := l.signDownload(ctx, up, obj.OID, download); err != nil {
+		slog.ErrorContext(ctx, "error signing download", "oid", obj.OID, "error", err)
+		return nil
+	}
+
+	cacheResp := BatchObjectResponse{
+		OID:           obj.OID,
+		Size:          obj.Size,
+		Authenticated: obj.Authenticated,
+		Actions:       map[string]*BatchObjectActionResponse{"download": download},
+	}
+
+	if err := l.cacheObjResponse(up.cacheKey(obj.OID), cacheResp); err != nil {
+		slog.ErrorContext(ctx, "error pre-caching response", "oid", obj.OID, "error", err)
+	}
+
+	return nil
+}
+
+// cacheObjectError remembers objects upstream reported missing for APP_NEGATIVE_CACHE_TTL,
+// so requests for them are answered without hitting upstream every time
+func (l LFSHandler) cacheObjectError(ctx context.Context, up *upstream, obj *BatchObjectResponse) {
+	if l.negativeCache == nil || obj.Error == nil {
 		return
 	}
 
-	url, headUrl, err := l.awsService.GetOIDPreSignedURL(obj.OID)
-	if err != nil {
-		log.Printf("error getting presigned: %v\n", err.Error())
+	if obj.Error.Code != http.StatusNotFound && obj.Error.Code != http.StatusGone {
 		return
 	}
 
-	cacheResp := BatchObjectResponse{
+	data, err := json.Marshal(obj.Error)
+	if err == nil {
+		err = l.negativeCache.Set(up.cacheKey(obj.OID), data)
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "error caching object error", "oid", obj.OID, "error", err)
+	}
+}
+
+// uploadedObject serves an object upstream reported missing from the object store when the proxy received it,
+// since with APP_UPLOAD_MODE=async upstream only gets it once its upload runs on the upload queue
+func (l LFSHandler) uploadedObject(ctx context.Context, up *upstream, obj *BatchObjectResponse) *BatchObjectResponse {
+	if !l.config.UploadEnabled || obj.Error == nil {
+		return nil
+	}
+
+	if obj.Error.Code != http.StatusNotFound && obj.Error.Code != http.StatusGone {
+		return nil
+	}
+
+	if exists, err := l.objectExists(ctx, up, obj.OID); err != nil || !exists {
+		return nil
+	}
+
+	download := &BatchObjectActionResponse{}
+	if err := l.signDownload(ctx, up, obj.OID, download); err != nil {
+		slog.ErrorContext(ctx, "error signing download", "oid", obj.OID, "error", err)
+		return nil
+	}
+	setExpiresIn(download)
+
+	return &BatchObjectResponse{
 		OID:           obj.OID,
 		Size:          obj.Size,
 		Authenticated: obj.Authenticated,
-		Actions: map[string]*BatchObjectActionResponse{
-			"download": {
-				Href:      url,
-				HeadHref:  headUrl,
-				Header:    obj.Actions["download"].Header,
-				ExpiresIn: obj.Actions["download"].ExpiresIn,
-				ExpiresAt: obj.Actions["download"].ExpiresAt,
-			},
-		},
+		Actions:       map[string]*BatchObjectActionResponse{"download": download},
+	}
+}
+
+// cachedObjectError returns the response of an object upstream recently reported missing, if any
+func (l LFSHandler) cachedObjectError(ctx context.Context, up *upstream, obj *BatchObjectResponse) *BatchObjectResponse {
+	if l.negativeCache == nil {
+		return nil
 	}
 
-	if err := l.cacheObjResponse(obj.OID, cacheResp); err != nil {
-		log.Printf("error pre-caching response %v\n", err.Error())
+	data, err := cacheGet(ctx, l.negativeCache, "missing", up.cacheKey(obj.OID))
+	if err != nil {
+		return nil
 	}
+
+	var objectError BatchObjectError
+	if err := json.Unmarshal(data, &objectError); err != nil {
+		return nil
+	}
+
+	return &BatchObjectResponse{
+		OID:   obj.OID,
+		Size:  obj.Size,
+		Error: &objectError,
+	}
+}
+
+// forgetObjectError drops the cached error of an object, such as when it is being uploaded
+func (l LFSHandler) forgetObjectError(up *upstream, oid string) {
+	if l.negativeCache == nil {
+		return
+	}
+
+	l.negativeCache.Delete(up.cacheKey(oid)) //nolint:errcheck
 }
 
-func (l LFSHandler) checkCachedLink(oid string, headHref string) {
-	r, _ := http.DefaultClient.Head(headHref)
+// signDownload points a download action to the object store, recording when its URL expires
+// instead of the expiry of the upstream URL it replaces
+func (l LFSHandler) signDownload(ctx context.Context, up *upstream, oid string, download *BatchObjectActionResponse) error {
+	// Taken before signing so the recorded expiry never comes after the actual one
+	signedAt := time.Now().Truncate(time.Second)
+
+	start := time.Now()
+	_, span := tracing.Start(ctx, "store.presign", trace.WithAttributes(tracing.OID(oid)))
+	url, headUrl, err := up.objectStore.GetOIDPreSignedURL(oid)
+	tracing.End(span, err)
+	l.promCollector.StoreLatency.With("operation", "presign").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+
+	download.Href = url
+	download.HeadHref = headUrl
+	download.ExpiresIn = 0
+	download.ExpiresAt = time.Time{}
+	if expiration := up.objectStore.URLExpiration(); expiration > 0 {
+		download.ExpiresAt = signedAt.Add(expiration).UTC()
+	}
+
+	return nil
+}
+
+// refreshCachedDownload re-signs cached download URLs about to expire and updates the cache entry in place,
+// so cached responses never hand out URLs expiring sooner than APP_CACHE_RESIGN_BEFORE
+func (l LFSHandler) refreshCachedDownload(ctx context.Context, up *upstream, obj *BatchObjectResponse) {
+	download, ok := obj.Actions["download"]
+	if !ok || download.ExpiresAt.IsZero() {
+		return
+	}
+
+	if time.Until(download.ExpiresAt) < l.config.CacheResignBefore {
+		if err := l.signDownload(ctx, up, obj.OID, download); err != nil {
+			slog.ErrorContext(ctx, "error re-signing download", "oid", obj.OID, "error", err)
+		} else if err := l.cacheObjResponse(up.cacheKey(obj.OID), *obj); err != nil {
+			slog.ErrorContext(ctx, "error caching response", "oid", obj.OID, "error", err)
+		}
+	}
+
+	setExpiresIn(download)
+}
+
+// setExpiresIn sets expires_in from expires_at, git-lfs prefers it since it doesn't depend on the client clock
+func setExpiresIn(download *BatchObjectActionResponse) {
+	if download.ExpiresAt.IsZero() {
+		return
+	}
+
+	download.ExpiresIn = max(int(time.Until(download.ExpiresAt).Seconds()), 1)
+}
+
+func (l LFSHandler) checkCachedLink(ctx context.Context, key string, headHref string) {
+	r, err := http.DefaultClient.Head(headHref)
+	if err != nil {
+		slog.WarnContext(ctx, "error checking cached link", "key", key, "error", err)
+		return
+	}
+	r.Body.Close()
+
 	if r.StatusCode != 200 {
-		log.Printf("removing %v from cache due to expired presigned link: %v\n", headHref, r.StatusCode)
-		l.cache.Delete(oid) //nolint:errcheck
+		slog.InfoContext(ctx, "removing cached response due to expired presigned link", "key", key, "status", r.StatusCode)
+		l.cache.Delete(key) //nolint:errcheck
+	}
+}
+
+// objectExists checks whether the object store holds an object
+func (l LFSHandler) objectExists(ctx context.Context, up *upstream, oid string) (bool, error) {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "store.head", trace.WithAttributes(tracing.OID(oid)))
+	exists, err := up.objectStore.OIDExists(oid)
+	span.SetAttributes(attribute.Bool("lfs.exists", exists))
+	tracing.End(span, err)
+	l.promCollector.StoreLatency.With("operation", "head").Observe(time.Since(start).Seconds())
+
+	return exists, err
+}
+
+// storeObject uploads an object to the object store
+func (l LFSHandler) storeObject(ctx context.Context, up *upstream, oid string, size int64, body io.ReadCloser) error {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "store.upload", trace.WithAttributes(tracing.OID(oid), attribute.Int64("lfs.size", size)))
+	err := up.objectStore.UploadOID(oid, body)
+	tracing.End(span, err)
+	l.promCollector.StoreLatency.With("operation", "upload").Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		l.promCollector.UploadFailures.With("destination", "store").Add(1)
 	}
+
+	return err
+}
+
+// doUpstream sends a request to the LFS API of upstream
+func (l LFSHandler) doUpstream(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	l.promCollector.UpstreamLatency.Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	l.promCollector.UpstreamResponses.With("code", code).Add(1)
+
+	return resp, err
+}
+
+// cacheGet looks a key up on one of the in-memory caches
+func cacheGet(ctx context.Context, c cache.Cache, name string, key string) ([]byte, error) {
+	_, span := tracing.Start(ctx, "cache.get", trace.WithAttributes(attribute.String("cache.name", name), attribute.String("cache.key", key)))
+	defer span.End()
+
+	data, err := c.Get(key)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+	if err != nil && !errors.Is(err, cache.ErrEntryNotFound) {
+		span.RecordError(err)
+	}
+
+	return data, err
 }
 
 func (l LFSHandler) cacheObjResponse(key string, obj BatchObjectResponse) error {
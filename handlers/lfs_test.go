@@ -3,29 +3,61 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/gin-gonic/gin"
 	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/vela-games/lfsproxy/config"
 	"github.com/vela-games/lfsproxy/exporter"
+	"github.com/vela-games/lfsproxy/queue"
+	"github.com/vela-games/lfsproxy/routing"
+	"github.com/vela-games/lfsproxy/services"
 )
 
+// Storage and cache keys are scoped to the repository at cfg.UpstreamBaseURL
+const testNamespace = "fake-git-server.com/repository.git/"
+
+// testOID returns the oid of a test object named after the role it plays in the test
+func testOID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewCollector registers its metrics globally so it can only be built once per test binary
+var testCollector = exporter.NewCollector()
+
 type MockCache struct {
 	Cache   map[string][]byte
 	KeysHit *[]string
+	mu      *sync.Mutex
+}
+
+func NewMockCache() MockCache {
+	return MockCache{
+		Cache:   make(map[string][]byte),
+		KeysHit: &[]string{},
+		mu:      &sync.Mutex{},
+	}
 }
 
 func (m MockCache) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	data, ok := m.Cache[key]
 	if !ok {
 		return nil, errors.New("Entry not found")
@@ -37,43 +69,83 @@ func (m MockCache) Get(key string) ([]byte, error) {
 }
 
 func (m MockCache) Set(key string, entry []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.Cache[key] = entry
 	return nil
 }
 
 func (m MockCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	delete(m.Cache, key)
 	return nil
 }
 
+func (m MockCache) Has(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.Cache[key]
+	return ok
+}
+
 func (m MockCache) Reset() {
-	m.Cache = make(map[string][]byte)
-	m.KeysHit = &[]string{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.Cache {
+		delete(m.Cache, key)
+	}
+	*m.KeysHit = []string{}
+}
+
+// startFillQueue runs an in-memory fill queue for the handler until the test ends
+func startFillQueue(t *testing.T, l *LFSHandler) {
+	var err error
+	l.fillQueue, err = queue.New(queue.Options{Workers: 4, MaxAttempts: 1}, func(ctx context.Context, job *queue.Job) error {
+		return l.runFillJob(ctx, job)
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go l.fillQueue.Run(ctx)
 }
 
-type MockAWSService struct {
+type MockObjectStore struct {
 	urls         map[string]string
-	uploadCalled *bool
+	uploadCalled *atomic.Bool
+	expiration   time.Duration
 }
 
-func (m MockAWSService) OIDExists(oid string) (bool, error) {
+func (m MockObjectStore) OIDExists(oid string) (bool, error) {
 	_, ok := m.urls[oid]
 	return ok, nil
 }
 
-func (m MockAWSService) GetOIDPreSignedURL(oid string) (string, string, error) {
+func (m MockObjectStore) GetOIDPreSignedURL(oid string) (string, string, error) {
 	url := m.urls[oid]
 	return url, url, nil
 }
 
-func (m MockAWSService) UploadOID(oid string, body io.ReadCloser) error {
-	*m.uploadCalled = true
+func (m MockObjectStore) URLExpiration() time.Duration {
+	return m.expiration
+}
+
+func (m MockObjectStore) UploadOID(oid string, body io.ReadCloser) error {
+	m.uploadCalled.Store(true)
 	return nil
 }
 
-func (m MockAWSService) Reset() {
-	*m.uploadCalled = false
-	m.urls = make(map[string]string)
+func (m MockObjectStore) Reset() {
+	m.uploadCalled.Store(false)
+	for oid := range m.urls {
+		delete(m.urls, oid)
+	}
 }
 
 func TestLFSHandler(t *testing.T) {
@@ -82,26 +154,25 @@ func TestLFSHandler(t *testing.T) {
 		CacheEviction:   1 * time.Minute,
 	}
 
-	cache := MockCache{
-		Cache:   make(map[string][]byte),
-		KeysHit: &[]string{},
-	}
+	cache := NewMockCache()
 
-	mockAWSService := MockAWSService{
+	mockObjectStore := MockObjectStore{
 		urls:         make(map[string]string),
-		uploadCalled: aws.Bool(false),
+		uploadCalled: &atomic.Bool{},
 	}
 
 	lfsHandler := LFSHandler{
 		cache:         cache,
-		promCollector: exporter.NewCollector(),
+		promCollector: testCollector,
+		fills:         &fillGroup{},
 		config:        cfg,
-		awsService:    mockAWSService,
+		objectStore:   mockObjectStore,
 	}
+	startFillQueue(t, &lfsHandler)
 
 	t.Run("it should get from upstream", func(t *testing.T) {
 		defer cache.Reset()
-		defer mockAWSService.Reset()
+		defer mockObjectStore.Reset()
 
 		httpmock.Activate()
 		defer httpmock.DeactivateAndReset()
@@ -137,11 +208,11 @@ func TestLFSHandler(t *testing.T) {
 			Transfers: []string{"basic"},
 			Objects: []*BatchObjectResponse{
 				{
-					OID:  "123",
+					OID:  testOID("123"),
 					Size: 123,
 				},
 				{
-					OID:  "asd1234",
+					OID:  testOID("asd1234"),
 					Size: 123,
 				},
 			},
@@ -149,7 +220,7 @@ func TestLFSHandler(t *testing.T) {
 			HashAlgo: "sha256",
 		}
 
-		batchResponse, statusCode, err := lfsHandler.getFromUpstream(context.TODO(), batchRequest, "/objects/batch", http.Header{})
+		batchResponse, statusCode, err := lfsHandler.getFromUpstream(context.TODO(), cfg.UpstreamBaseURL, batchRequest, "/objects/batch", http.Header{})
 		assert.NoError(t, err)
 		assert.Equal(t, 200, statusCode)
 		assert.Equal(t, "basic", batchResponse.Transfer)
@@ -157,7 +228,7 @@ func TestLFSHandler(t *testing.T) {
 
 	t.Run("it should return all cached responses", func(t *testing.T) {
 		defer cache.Reset()
-		defer mockAWSService.Reset()
+		defer mockObjectStore.Reset()
 
 		httpmock.Activate()
 		defer httpmock.DeactivateAndReset()
@@ -169,9 +240,9 @@ func TestLFSHandler(t *testing.T) {
 			},
 		)
 
-		now := time.Now()
+		now := time.Now().Add(24 * time.Hour)
 		obj := BatchObjectResponse{
-			OID:           "123",
+			OID:           testOID("123"),
 			Size:          123,
 			Authenticated: false,
 			Actions: map[string]*BatchObjectActionResponse{
@@ -188,7 +259,7 @@ func TestLFSHandler(t *testing.T) {
 		}
 
 		if data, err := json.Marshal(obj); err == nil {
-			cache.Set("123", data)
+			cache.Set(testNamespace+testOID("123"), data)
 		}
 
 		w := httptest.NewRecorder()
@@ -202,7 +273,7 @@ func TestLFSHandler(t *testing.T) {
 			"ref": { "name": "refs/heads/main" },
 			"objects": [
 				{
-					"oid": "123",
+					"oid": "` + testOID("123") + `",
 					"size": 123
 				}
 			],
@@ -224,14 +295,14 @@ func TestLFSHandler(t *testing.T) {
 		assert.Equal(t, 200, w.Code)
 		assert.Equal(t, 1, len(*cache.KeysHit))
 
-		expected := fmt.Sprintf(`{"objects":[{"oid":"123","size":123,"actions":{"download":{"href":"https://fake-url.com","head_href":"https://fake-url.com","header":{"Content-Type":"application/octet-stream"},"expires_at":"%v"}}}]}`, now.Format(time.RFC3339Nano))
+		expected := fmt.Sprintf(`{"transfer":"basic","objects":[{"oid":"`+testOID("123")+`","size":123,"actions":{"download":{"href":"https://fake-url.com","head_href":"https://fake-url.com","header":{"Content-Type":"application/octet-stream"},"expires_in":86399,"expires_at":"%v"}}}]}`, now.Format(time.RFC3339Nano))
 
-		assert.Equal(t, expected, string(b))
+		assertBatchResponse(t, expected, b)
 	})
 
 	t.Run("it should return a mix of cached and upstream responses - with no URLs from S3", func(t *testing.T) {
 		defer cache.Reset()
-		defer mockAWSService.Reset()
+		defer mockObjectStore.Reset()
 
 		httpmock.Activate()
 		defer httpmock.DeactivateAndReset()
@@ -242,7 +313,7 @@ func TestLFSHandler(t *testing.T) {
 					"transfer": "basic",
 					"objects": []map[string]interface{}{
 						{
-							"oid":           "1234",
+							"oid":           testOID("1234"),
 							"size":          123,
 							"authenticated": true,
 							"actions": map[string]interface{}{
@@ -264,9 +335,9 @@ func TestLFSHandler(t *testing.T) {
 
 		httpmock.RegisterResponder("GET", "https://some-download.com", httpmock.NewStringResponder(200, ""))
 
-		now := time.Now()
+		now := time.Now().Add(24 * time.Hour)
 		obj := BatchObjectResponse{
-			OID:           "123",
+			OID:           testOID("123"),
 			Size:          123,
 			Authenticated: false,
 			Actions: map[string]*BatchObjectActionResponse{
@@ -283,7 +354,7 @@ func TestLFSHandler(t *testing.T) {
 		}
 
 		if data, err := json.Marshal(obj); err == nil {
-			cache.Set("123", data)
+			cache.Set(testNamespace+testOID("123"), data)
 		}
 
 		w := httptest.NewRecorder()
@@ -297,11 +368,11 @@ func TestLFSHandler(t *testing.T) {
 			"ref": { "name": "refs/heads/main" },
 			"objects": [
 				{
-					"oid": "123",
+					"oid": "` + testOID("123") + `",
 					"size": 123
 				},
 				{
-					"oid": "1234",
+					"oid": "` + testOID("1234") + `",
 					"size": 123
 				}
 			],
@@ -323,20 +394,20 @@ func TestLFSHandler(t *testing.T) {
 		assert.Equal(t, 200, w.Code)
 		assert.Equal(t, 1, len(*cache.KeysHit))
 
-		expected := fmt.Sprintf(`{"transfer":"basic","objects":[{"oid":"123","size":123,"actions":{"download":{"href":"https://fake-url.com","head_href":"https://fake-url.com","header":{"Content-Type":"application/octet-stream"},"expires_at":"%v"}}},{"oid":"1234","size":123,"authenticated":true,"actions":{"download":{"href":"https://some-download.com","header":{"Key":"value"},"expires_at":"2016-11-10T15:29:07Z"}}}]}`, now.Format(time.RFC3339Nano))
+		expected := fmt.Sprintf(`{"transfer":"basic","objects":[{"oid":"`+testOID("123")+`","size":123,"actions":{"download":{"href":"https://fake-url.com","head_href":"https://fake-url.com","header":{"Content-Type":"application/octet-stream"},"expires_in":86399,"expires_at":"%v"}}},{"oid":"`+testOID("1234")+`","size":123,"authenticated":true,"actions":{"download":{"href":"https://some-download.com","header":{"Key":"value"},"expires_at":"2016-11-10T15:29:07Z"}}}]}`, now.Format(time.RFC3339Nano))
 
-		assert.Equal(t, expected, string(b))
+		assertBatchResponse(t, expected, b)
 
 		assert.Eventually(t, func() bool {
-			return *mockAWSService.uploadCalled
+			return mockObjectStore.uploadCalled.Load() && cache.Has(testNamespace+testOID("1234"))
 		}, 1*time.Second, 100*time.Millisecond)
 	})
 
 	t.Run("it should return a mix of cached and upstream responses - with URLs from S3", func(t *testing.T) {
 		defer cache.Reset()
-		defer mockAWSService.Reset()
+		defer mockObjectStore.Reset()
 
-		mockAWSService.urls["1234"] = "https://this-is-from-s3.com"
+		mockObjectStore.urls[testNamespace+testOID("1234")] = "https://this-is-from-s3.com"
 
 		httpmock.Activate()
 		defer httpmock.DeactivateAndReset()
@@ -347,7 +418,7 @@ func TestLFSHandler(t *testing.T) {
 					"transfer": "basic",
 					"objects": []map[string]interface{}{
 						{
-							"oid":           "1234",
+							"oid":           testOID("1234"),
 							"size":          123,
 							"authenticated": true,
 							"actions": map[string]interface{}{
@@ -367,9 +438,9 @@ func TestLFSHandler(t *testing.T) {
 			},
 		)
 
-		now := time.Now()
+		now := time.Now().Add(24 * time.Hour)
 		obj := BatchObjectResponse{
-			OID:           "123",
+			OID:           testOID("123"),
 			Size:          123,
 			Authenticated: false,
 			Actions: map[string]*BatchObjectActionResponse{
@@ -386,7 +457,7 @@ func TestLFSHandler(t *testing.T) {
 		}
 
 		if data, err := json.Marshal(obj); err == nil {
-			cache.Set("123", data)
+			cache.Set(testNamespace+testOID("123"), data)
 		}
 
 		w := httptest.NewRecorder()
@@ -400,11 +471,11 @@ func TestLFSHandler(t *testing.T) {
 			"ref": { "name": "refs/heads/main" },
 			"objects": [
 				{
-					"oid": "123",
+					"oid": "` + testOID("123") + `",
 					"size": 123
 				},
 				{
-					"oid": "1234",
+					"oid": "` + testOID("1234") + `",
 					"size": 123
 				}
 			],
@@ -426,10 +497,827 @@ func TestLFSHandler(t *testing.T) {
 		assert.Equal(t, 200, w.Code)
 		assert.Equal(t, 1, len(*cache.KeysHit))
 
-		expected := fmt.Sprintf(`{"transfer":"basic","objects":[{"oid":"123","size":123,"actions":{"download":{"href":"https://fake-url.com","head_href":"https://fake-url.com","header":{"Content-Type":"application/octet-stream"},"expires_at":"%v"}}},{"oid":"1234","size":123,"authenticated":true,"actions":{"download":{"href":"https://this-is-from-s3.com","head_href":"https://this-is-from-s3.com","header":{"Key":"value"},"expires_at":"2016-11-10T15:29:07Z"}}}]}`, now.Format(time.RFC3339Nano))
+		expected := fmt.Sprintf(`{"transfer":"basic","objects":[{"oid":"`+testOID("123")+`","size":123,"actions":{"download":{"href":"https://fake-url.com","head_href":"https://fake-url.com","header":{"Content-Type":"application/octet-stream"},"expires_in":86399,"expires_at":"%v"}}},{"oid":"`+testOID("1234")+`","size":123,"authenticated":true,"actions":{"download":{"href":"https://this-is-from-s3.com","head_href":"https://this-is-from-s3.com","header":{"Key":"value"},"expires_at":"0001-01-01T00:00:00Z"}}}]}`, now.Format(time.RFC3339Nano))
+
+		assertBatchResponse(t, expected, b)
+
+		assert.Equal(t, false, mockObjectStore.uploadCalled.Load())
+	})
+}
+
+// assertBatchResponse compares batch responses, expecting expires_in to count down from the expected one
+// for as long as the test takes
+func assertBatchResponse(t *testing.T, expected string, actual []byte) {
+	t.Helper()
+
+	var want, got BatchResponse
+	require.NoError(t, json.Unmarshal([]byte(expected), &want))
+	require.NoError(t, json.Unmarshal(actual, &got))
+	require.Len(t, got.Objects, len(want.Objects))
+
+	for i, obj := range got.Objects {
+		for name, action := range obj.Actions {
+			if wantAction, ok := want.Objects[i].Actions[name]; ok && wantAction.ExpiresIn > 0 {
+				assert.LessOrEqual(t, action.ExpiresIn, wantAction.ExpiresIn)
+				assert.GreaterOrEqual(t, action.ExpiresIn, wantAction.ExpiresIn-5)
+				action.ExpiresIn = wantAction.ExpiresIn
+			}
+		}
+	}
+
+	assert.Equal(t, want, got)
+}
+
+func TestLFSHandlerRouting(t *testing.T) {
+	routes, err := routing.NewTable([]routing.Route{
+		{Prefix: "vela-games/", Upstream: "https://fake-git-server.com/{owner}/{repo}.git/info/lfs/", KeyPrefix: "vela"},
+		{Repository: "vela-games/game.git", Upstream: "https://game.fake-git-server.com/game.git/info/lfs/", Bucket: "game-lfs"},
+	})
+	require.NoError(t, err)
+
+	defaultStore := MockObjectStore{
+		urls:         map[string]string{"vela/fake-git-server.com/vela-games/tools.git/" + testOID("1234"): "https://default-bucket.com/vela/1234"},
+		uploadCalled: &atomic.Bool{},
+	}
+
+	gameStore := MockObjectStore{
+		urls:         map[string]string{"game.fake-git-server.com/game.git/" + testOID("1234"): "https://game-bucket.com/1234"},
+		uploadCalled: &atomic.Bool{},
+	}
+
+	cache := NewMockCache()
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        &config.Config{},
+		objectStore:   defaultStore,
+		bucketStores:  map[string]services.ObjectStore{"game-lfs": gameStore},
+		routes:        routes,
+	}
+	startFillQueue(t, &lfsHandler)
+
+	upstreamResponder := func(req *http.Request) (*http.Response, error) {
+		return httpmock.NewJsonResponse(200, map[string]interface{}{
+			"objects": []map[string]interface{}{
+				{
+					"oid":  testOID("1234"),
+					"size": 123,
+					"actions": map[string]interface{}{
+						"download": map[string]interface{}{"href": "https://some-download.com"},
+					},
+				},
+			},
+		})
+	}
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/vela-games/tools.git/info/lfs/objects/batch", upstreamResponder)
+	httpmock.RegisterResponder("POST", "https://game.fake-git-server.com/game.git/info/lfs/objects/batch", upstreamResponder)
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+	r.POST("/:owner/:repo/info/lfs/objects/batch", lfsHandler.PostBatch)
+
+	batch := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:9999"+path, bytes.NewBufferString(`{"operation":"download","objects":[{"oid":"`+testOID("1234")+`","size":123}]}`))
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("it should route prefixes to templated upstreams with their key prefix", func(t *testing.T) {
+		defer cache.Reset()
+
+		w := batch("/vela-games/tools.git/info/lfs/objects/batch")
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "https://default-bucket.com/vela/1234")
+	})
+
+	t.Run("it should route exact matches to their bucket", func(t *testing.T) {
+
+		w := batch("/vela-games/game.git/info/lfs/objects/batch")
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "https://game-bucket.com/1234")
+	})
+
+	t.Run("it should not serve cached objects of another repository", func(t *testing.T) {
+		defer cache.Reset()
+
+		// The game repository response is still cached from the previous run
+		w := batch("/vela-games/tools.git/info/lfs/objects/batch")
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "https://default-bucket.com/vela/1234")
+		assert.NotContains(t, w.Body.String(), "https://game-bucket.com/1234")
+	})
+
+	t.Run("it should share objects across repositories with cross-repository dedupe", func(t *testing.T) {
+		defer cache.Reset()
+
+		lfsHandler.config.CrossRepositoryDedupe = true
+		defer func() { lfsHandler.config.CrossRepositoryDedupe = false }()
+
+		defaultStore.urls["vela/"+testOID("1234")] = "https://default-bucket.com/shared/1234"
+
+		w := batch("/vela-games/tools.git/info/lfs/objects/batch")
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "https://default-bucket.com/shared/1234")
+	})
+
+	t.Run("it should return 404 for unrouted repositories", func(t *testing.T) {
+		assert.Equal(t, 404, batch("/someone/else.git/info/lfs/objects/batch").Code)
+	})
+
+	t.Run("it should return 404 on the single repository route without an upstream", func(t *testing.T) {
+		assert.Equal(t, 404, batch("/objects/batch").Code)
+	})
+}
+
+func TestLFSHandlerAuthCheck(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL:  "https://fake-git-server.com/repository.git/",
+		AuthCheckEnabled: true,
+	}
+
+	cache := NewMockCache()
+	authCache := NewMockCache()
+
+	cachedObject, err := json.Marshal(BatchObjectResponse{
+		OID:  testOID("1234"),
+		Size: 123,
+		Actions: map[string]*BatchObjectActionResponse{
+			"download": {Href: "https://cached-download.com/1234"},
+		},
+	})
+	require.NoError(t, err)
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		authCache:     authCache,
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        cfg,
+		objectStore:   MockObjectStore{urls: map[string]string{}, uploadCalled: &atomic.Bool{}},
+	}
+	startFillQueue(t, &lfsHandler)
+
+	upstreamCalls := 0
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/objects/batch",
+		func(req *http.Request) (*http.Response, error) {
+			upstreamCalls++
+
+			switch req.Header.Get("Authorization") {
+			case "Basic allowed":
+				return httpmock.NewJsonResponse(200, map[string]interface{}{"objects": []interface{}{}})
+			case "Basic forbidden":
+				return httpmock.NewJsonResponse(403, map[string]interface{}{"message": "no access to repository"})
+			case "Basic broken":
+				return httpmock.NewStringResponse(502, "bad gateway"), nil
+			default:
+				return httpmock.NewJsonResponse(401, map[string]interface{}{"message": "credentials needed"})
+			}
+		},
+	)
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+
+	batch := func(authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:9999/objects/batch", bytes.NewBufferString(`{"operation":"download","objects":[{"oid":"`+testOID("1234")+`","size":123}]}`))
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	reset := func() {
+		cache.Reset()
+		authCache.Reset()
+		upstreamCalls = 0
+		require.NoError(t, cache.Set(testNamespace+testOID("1234"), cachedObject))
+	}
+
+	t.Run("it should serve cached objects to authorized callers", func(t *testing.T) {
+		reset()
+
+		w := batch("Basic allowed")
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "https://cached-download.com/1234")
+		assert.Equal(t, 1, upstreamCalls)
+	})
+
+	t.Run("it should cache authorization decisions per credential", func(t *testing.T) {
+		reset()
+
+		assert.Equal(t, 200, batch("Basic allowed").Code)
+		assert.Equal(t, 200, batch("Basic allowed").Code)
+		assert.Equal(t, 1, upstreamCalls)
+
+		assert.Equal(t, 403, batch("Basic forbidden").Code)
+		assert.Equal(t, 403, batch("Basic forbidden").Code)
+		assert.Equal(t, 2, upstreamCalls)
+
+		// Credentials are never kept in the cache
+		for key := range authCache.Cache {
+			assert.NotContains(t, key, "forbidden")
+		}
+	})
+
+	t.Run("it should answer anonymous callers with an LFS 401", func(t *testing.T) {
+		reset()
+
+		w := batch("")
+		assert.Equal(t, 401, w.Code)
+		assert.Equal(t, `Basic realm="Git LFS"`, w.Header().Get("LFS-Authenticate"))
+		assert.Equal(t, "application/vnd.git-lfs+json", w.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"message":"credentials needed"}`, w.Body.String())
+		assert.NotContains(t, w.Body.String(), "https://cached-download.com/1234")
+	})
+
+	t.Run("it should answer denied callers with an LFS 403", func(t *testing.T) {
+		reset()
+
+		w := batch("Basic forbidden")
+		assert.Equal(t, 403, w.Code)
+		assert.Empty(t, w.Header().Get("LFS-Authenticate"))
+		assert.JSONEq(t, `{"message":"no access to repository"}`, w.Body.String())
+	})
+
+	t.Run("it should not cache upstream failures", func(t *testing.T) {
+		reset()
+
+		assert.Equal(t, 502, batch("Basic broken").Code)
+		assert.Equal(t, 502, batch("Basic broken").Code)
+		assert.Equal(t, 2, upstreamCalls)
+		assert.Empty(t, authCache.Cache)
+	})
+
+	t.Run("it should not check authorization when disabled", func(t *testing.T) {
+		reset()
+
+		cfg.AuthCheckEnabled = false
+		defer func() { cfg.AuthCheckEnabled = true }()
+
+		assert.Equal(t, 200, batch("").Code)
+		assert.Equal(t, 0, upstreamCalls)
+	})
+}
+
+func TestLFSHandlerVerification(t *testing.T) {
+	// sha256 of "0123456789"
+	oid := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+	fs, err := services.NewFSService(t.TempDir(), services.NewHrefSigner("http://localhost:9999", []byte("secret"), 1*time.Hour))
+	require.NoError(t, err)
+
+	cache := NewMockCache()
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        &config.Config{},
+		objectStore:   fs,
+	}
+	startFillQueue(t, &lfsHandler)
+
+	up := lfsHandler.newUpstream("https://fake-git-server.com/repository.git/", "", "", "/objects/batch")
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "https://some-download.com/valid", httpmock.NewStringResponder(200, "0123456789"))
+	httpmock.RegisterResponder("GET", "https://some-download.com/corrupted", httpmock.NewStringResponder(200, "0123456780"))
+	httpmock.RegisterResponder("GET", "https://some-download.com/truncated", httpmock.NewStringResponder(200, "01234"))
+
+	pull := func(href string) {
+		urls := make(chan BatchObjectResponse, 1)
+		lfsHandler.pullS3(context.Background(), up, BatchObjectResponse{
+			OID:     oid,
+			Size:    10,
+			Actions: map[string]*BatchObjectActionResponse{"download": {Href: href}},
+		}, urls)
+		<-urls
+	}
+
+	for _, href := range []string{"https://some-download.com/corrupted", "https://some-download.com/truncated"} {
+		t.Run("it should not cache mismatching content from "+href, func(t *testing.T) {
+			pull(href)
+
+			assert.Never(t, func() bool {
+				exists, _ := fs.OIDExists(testNamespace + oid)
+				return exists || cache.Has(testNamespace+oid)
+			}, 200*time.Millisecond, 10*time.Millisecond)
+		})
+	}
+
+	t.Run("it should cache matching content", func(t *testing.T) {
+		pull("https://some-download.com/valid")
+
+		assert.Eventually(t, func() bool {
+			exists, _ := fs.OIDExists(testNamespace + oid)
+			return exists && cache.Has(testNamespace+oid)
+		}, 1*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should not retry fills of mismatching content", func(t *testing.T) {
+		retryingHandler := lfsHandler
+		retryingHandler.config = &config.Config{FillQueueMaxAttempts: 5, FillQueueInitialBackoff: 10 * time.Millisecond}
+		retryingHandler.objectStore, err = services.NewFSService(t.TempDir(), nil)
+		require.NoError(t, err)
+
+		retryingHandler.fillQueue, err = retryingHandler.newFillQueue()
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go retryingHandler.fillQueue.Run(ctx)
+
+		retries := metricValue(t, "lfsproxy_fill_queue_retry")
+		deadLettered := metricValue(t, "lfsproxy_fill_queue_dead_letter")
+
+		retryingHandler.enqueueFill(context.Background(), up, BatchObjectResponse{
+			OID:     oid,
+			Size:    10,
+			Actions: map[string]*BatchObjectActionResponse{"download": {Href: "https://some-download.com/corrupted"}},
+		})
+
+		assert.Eventually(t, func() bool {
+			return metricValue(t, "lfsproxy_fill_queue_dead_letter") == deadLettered+1
+		}, 1*time.Second, 10*time.Millisecond)
+		assert.Equal(t, retries, metricValue(t, "lfsproxy_fill_queue_retry"))
+	})
+}
+
+func TestLFSHandlerVerificationS3(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+	t.Setenv("AWS_REGION", "us-east-1")
+	// A custom CA bundle makes the SDK replace the transport of http.DefaultClient, which httpmock relies on
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	// sha256 of "0123456789"
+	oid := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+	var puts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		puts.Add(1)
+	}))
+	defer srv.Close()
+
+	store, err := services.NewAWSService(services.AWSOptions{Bucket: "test-bucket", Endpoint: srv.URL, ForcePathStyle: true})
+	require.NoError(t, err)
+
+	lfsHandler := LFSHandler{
+		cache:         NewMockCache(),
+		promCollector: testCollector,
+		config:        &config.Config{},
+		objectStore:   store,
+	}
+
+	up := lfsHandler.newUpstream("https://fake-git-server.com/repository.git/", "", "", "/objects/batch")
+
+	t.Run("it should count mismatching content rejected by S3 uploads", func(t *testing.T) {
+		failures := metricValue(t, "lfsproxy_verification_failure")
+
+		err := lfsHandler.pushToS3(context.Background(), up, BatchObjectResponse{
+			OID:     oid,
+			Size:    10,
+			Actions: map[string]*BatchObjectActionResponse{"download": {Href: "https://some-download.com"}},
+		}, services.NewVerifyingReader(io.NopCloser(strings.NewReader("0123456780")), oid, 10))
+
+		assert.ErrorIs(t, err, services.ErrContentMismatch)
+		assert.Equal(t, failures+1, metricValue(t, "lfsproxy_verification_failure"))
+		assert.Equal(t, int32(0), puts.Load())
+	})
+}
+
+// leasedObjectStore is an object store whose leases are held by another replica
+type leasedObjectStore struct {
+	services.ObjectStore
+}
+
+func (leasedObjectStore) AcquireLease(oid string, ttl time.Duration) (bool, error) {
+	return false, nil
+}
+
+func (leasedObjectStore) RenewLease(oid string, ttl time.Duration) (bool, error) {
+	return false, nil
+}
+
+func (leasedObjectStore) ReleaseLease(oid string) error {
+	return nil
+}
+
+// renewingObjectStore is an object store granting leases and counting their renewals and releases
+type renewingObjectStore struct {
+	services.ObjectStore
+	renewals *atomic.Int32
+	releases *atomic.Int32
+}
+
+func (renewingObjectStore) AcquireLease(oid string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (s renewingObjectStore) RenewLease(oid string, ttl time.Duration) (bool, error) {
+	s.renewals.Add(1)
+	return true, nil
+}
+
+func (s renewingObjectStore) ReleaseLease(oid string) error {
+	s.releases.Add(1)
+	return nil
+}
+
+func TestLFSHandlerFillCoalescing(t *testing.T) {
+	// sha256 of "0123456789"
+	oid := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+	fs, err := services.NewFSService(t.TempDir(), services.NewHrefSigner("http://localhost:9999", []byte("secret"), 1*time.Hour))
+	require.NoError(t, err)
+
+	cfg := &config.Config{FillLeaseTTL: 1 * time.Minute}
+
+	lfsHandler := LFSHandler{
+		cache:         NewMockCache(),
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        cfg,
+		objectStore:   fs,
+	}
+	startFillQueue(t, &lfsHandler)
+
+	var downloads atomic.Int32
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "https://some-download.com",
+		func(req *http.Request) (*http.Response, error) {
+			downloads.Add(1)
+			time.Sleep(200 * time.Millisecond)
+			return httpmock.NewStringResponse(200, "0123456789"), nil
+		},
+	)
+
+	pullAll := func(l LFSHandler, oid string, n int) {
+		up := l.newUpstream("https://fake-git-server.com/repository.git/", "", "", "/objects/batch")
+
+		urls := make(chan BatchObjectResponse, n)
+		for i := 0; i < n; i++ {
+			go l.pullS3(context.Background(), up, BatchObjectResponse{
+				OID:     oid,
+				Size:    10,
+				Actions: map[string]*BatchObjectActionResponse{"download": {Href: "https://some-download.com"}},
+			}, urls)
+		}
+		for i := 0; i < n; i++ {
+			<-urls
+		}
+	}
+
+	t.Run("it should download concurrently missed objects once", func(t *testing.T) {
+		pullAll(lfsHandler, oid, 20)
+
+		assert.Eventually(t, func() bool {
+			exists, _ := fs.OIDExists(testNamespace + oid)
+			return exists
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int32(1), downloads.Load())
+	})
+
+	t.Run("it should not download objects leased by another replica", func(t *testing.T) {
+		downloads.Store(0)
+
+		leasedCfg := *cfg
+		leasedCfg.FillLeaseEnabled = true
+
+		leasedHandler := lfsHandler
+		leasedHandler.config = &leasedCfg
+		leasedHandler.objectStore = leasedObjectStore{ObjectStore: fs}
+		startFillQueue(t, &leasedHandler)
+
+		pullAll(leasedHandler, "leased-oid", 5)
+
+		assert.Never(t, func() bool {
+			return downloads.Load() > 0
+		}, 300*time.Millisecond, 10*time.Millisecond)
+	})
+
+	t.Run("it should renew leases while filling", func(t *testing.T) {
+		defer fs.Remove(testNamespace + oid) //nolint:errcheck
+
+		leasedCfg := *cfg
+		leasedCfg.FillLeaseEnabled = true
+		leasedCfg.FillLeaseTTL = 30 * time.Millisecond
+
+		var renewals, releases atomic.Int32
+		leasedHandler := lfsHandler
+		leasedHandler.config = &leasedCfg
+		leasedHandler.objectStore = renewingObjectStore{ObjectStore: fs, renewals: &renewals, releases: &releases}
+
+		up := leasedHandler.newUpstream("https://fake-git-server.com/repository.git/", "", "", "/objects/batch")
+		require.NoError(t, fs.Remove(testNamespace+oid))
+		require.NoError(t, leasedHandler.fill(context.Background(), up, BatchObjectResponse{
+			OID:     oid,
+			Size:    10,
+			Actions: map[string]*BatchObjectActionResponse{"download": {Href: "https://some-download.com"}},
+		}))
+
+		// The download takes 200ms, past the TTL of the lease
+		assert.GreaterOrEqual(t, renewals.Load(), int32(2))
+		assert.Equal(t, int32(1), releases.Load())
+	})
+
+	t.Run("it should retry fills leased by another replica until the object is stored", func(t *testing.T) {
+		downloads.Store(0)
+
+		leasedCfg := *cfg
+		leasedCfg.FillLeaseEnabled = true
+		leasedCfg.FillQueueWorkers = 1
+		leasedCfg.FillQueueMaxAttempts = 1
+		leasedCfg.FillQueueInitialBackoff = 50 * time.Millisecond
+
+		leasedHandler := lfsHandler
+		leasedHandler.config = &leasedCfg
+		leasedHandler.objectStore = leasedObjectStore{ObjectStore: fs}
+		leasedHandler.fillQueue, err = leasedHandler.newFillQueue()
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go leasedHandler.fillQueue.Run(ctx)
+
+		retries := metricValue(t, "lfsproxy_fill_queue_retry")
+		completed := metricValue(t, "lfsproxy_fill_queue_completed")
+
+		pullAll(leasedHandler, "retried-oid", 1)
+
+		// Waiting for the lease doesn't use up the attempts of the fill
+		assert.Never(t, func() bool {
+			return leasedHandler.fillQueue.Len() == 0
+		}, 300*time.Millisecond, 10*time.Millisecond)
+		assert.Equal(t, retries, metricValue(t, "lfsproxy_fill_queue_retry"))
+		assert.Equal(t, completed, metricValue(t, "lfsproxy_fill_queue_completed"))
+
+		// The replica holding the lease stores the object
+		require.NoError(t, fs.UploadOID(testNamespace+"retried-oid", io.NopCloser(strings.NewReader("content"))))
+
+		assert.Eventually(t, func() bool {
+			return metricValue(t, "lfsproxy_fill_queue_completed") == completed+1
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int32(0), downloads.Load())
+	})
+}
+
+func TestObjectCacheTTL(t *testing.T) {
+	t.Run("it should keep entries until their URLs are re-signed with the default configuration", func(t *testing.T) {
+		t.Setenv("APP_UPSTREAM_BASE_URL", "https://fake-git-server.com/repository.git/")
+		cfg, err := config.GetConfig()
+		require.NoError(t, err)
+
+		ttl := objectCacheTTL(cfg, cfg.S3PresignExpiration)
+		assert.Greater(t, ttl, cfg.S3PresignExpiration-cfg.CacheResignBefore)
+		assert.GreaterOrEqual(t, ttl, cfg.S3PresignExpiration)
+	})
+
+	t.Run("it should keep the configured eviction when it outlives re-signed URLs", func(t *testing.T) {
+		cfg := &config.Config{CacheEviction: 48 * time.Hour, CacheResignBefore: 1 * time.Hour}
+		assert.Equal(t, 48*time.Hour, objectCacheTTL(cfg, 24*time.Hour))
+	})
+
+	t.Run("it should keep the configured eviction when URLs outlive it", func(t *testing.T) {
+		cfg := &config.Config{CacheEviction: 23 * time.Hour}
+		assert.Equal(t, 23*time.Hour, objectCacheTTL(cfg, 24*time.Hour))
+	})
+
+	t.Run("it should expire entries before their URLs", func(t *testing.T) {
+		cfg := &config.Config{CacheEviction: 23 * time.Hour}
+		assert.Equal(t, 11*time.Hour+30*time.Minute, objectCacheTTL(cfg, 12*time.Hour))
+	})
+
+	t.Run("it should keep the configured eviction when URLs don't expire", func(t *testing.T) {
+		cfg := &config.Config{CacheEviction: 23 * time.Hour}
+		assert.Equal(t, 23*time.Hour, objectCacheTTL(cfg, 0))
+	})
+}
+
+func TestLFSHandlerResign(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL:   "https://fake-git-server.com/repository.git/",
+		CacheResignBefore: 1 * time.Hour,
+	}
+
+	cache := NewMockCache()
+	mockObjectStore := MockObjectStore{
+		urls:         map[string]string{testNamespace + testOID("123"): "https://resigned-url.com"},
+		uploadCalled: &atomic.Bool{},
+		expiration:   24 * time.Hour,
+	}
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        cfg,
+		objectStore:   mockObjectStore,
+	}
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+
+	batch := func(expiresAt time.Time) *BatchObjectActionResponse {
+		data, err := json.Marshal(BatchObjectResponse{
+			OID:  testOID("123"),
+			Size: 123,
+			Actions: map[string]*BatchObjectActionResponse{
+				"download": {Href: "https://cached-url.com", ExpiresAt: expiresAt},
+			},
+		})
+		require.NoError(t, err)
+		require.NoError(t, cache.Set(testNamespace+testOID("123"), data))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:9999/objects/batch", bytes.NewBufferString(`{"operation":"download","objects":[{"oid":"`+testOID("123")+`","size":123}]}`))
+		r.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+
+		var batchResponse BatchResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batchResponse))
+		require.Len(t, batchResponse.Objects, 1)
+
+		return batchResponse.Objects[0].Actions["download"]
+	}
+
+	t.Run("it should serve cached urls with the time left until they expire", func(t *testing.T) {
+		defer cache.Reset()
+
+		download := batch(time.Now().Add(2 * time.Hour))
+		assert.Equal(t, "https://cached-url.com", download.Href)
+		assert.InDelta(t, 2*3600, download.ExpiresIn, 2)
+	})
+
+	t.Run("it should re-sign cached urls about to expire in place", func(t *testing.T) {
+		defer cache.Reset()
+
+		download := batch(time.Now().Add(10 * time.Minute))
+		assert.Equal(t, "https://resigned-url.com", download.Href)
+		assert.InDelta(t, 24*3600, download.ExpiresIn, 2)
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), download.ExpiresAt, 2*time.Second)
+
+		var cached BatchObjectResponse
+		data, err := cache.Get(testNamespace + testOID("123"))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &cached))
+		assert.Equal(t, "https://resigned-url.com", cached.Actions["download"].Href)
+		assert.Equal(t, download.ExpiresAt, cached.Actions["download"].ExpiresAt)
+		assert.Zero(t, cached.Actions["download"].ExpiresIn)
+	})
+
+	t.Run("it should re-sign expired cached urls", func(t *testing.T) {
+		defer cache.Reset()
+
+		download := batch(time.Now().Add(-1 * time.Minute))
+		assert.Equal(t, "https://resigned-url.com", download.Href)
+	})
+}
+
+func TestLFSHandlerObjectErrors(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL:  "https://fake-git-server.com/repository.git/",
+		NegativeCacheTTL: 1 * time.Minute,
+	}
+
+	negativeCache := NewMockCache()
+	mockObjectStore := MockObjectStore{
+		urls:         map[string]string{testNamespace + testOID("present"): "https://this-is-from-s3.com"},
+		uploadCalled: &atomic.Bool{},
+	}
+
+	lfsHandler := LFSHandler{
+		cache:         NewMockCache(),
+		negativeCache: negativeCache,
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        cfg,
+		objectStore:   mockObjectStore,
+	}
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var requested atomic.Int32
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/objects/batch",
+		func(req *http.Request) (*http.Response, error) {
+			requested.Add(1)
+
+			var batchRequest BatchRequest
+			if err := json.NewDecoder(req.Body).Decode(&batchRequest); err != nil {
+				return nil, err
+			}
+
+			objects := []map[string]interface{}{}
+			for _, obj := range batchRequest.Objects {
+				switch obj.OID {
+				case testOID("present"):
+					objects = append(objects, map[string]interface{}{
+						"oid": obj.OID, "size": obj.Size,
+						"actions": map[string]interface{}{"download": map[string]interface{}{"href": "https://some-download.com"}},
+					})
+				case testOID("missing"):
+					objects = append(objects, map[string]interface{}{
+						"oid": obj.OID, "size": obj.Size,
+						"error": map[string]interface{}{"code": 404, "message": "Object does not exist"},
+					})
+				case testOID("invalid"):
+					objects = append(objects, map[string]interface{}{
+						"oid": obj.OID, "size": obj.Size,
+						"error": map[string]interface{}{"code": 422, "message": "Invalid object"},
+					})
+				}
+			}
+
+			return httpmock.NewJsonResponse(200, map[string]interface{}{"transfer": "basic", "objects": objects})
+		},
+	)
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+
+	batch := func(operation string, oids ...string) map[string]*BatchObjectResponse {
+		objects := []string{}
+		for _, oid := range oids {
+			objects = append(objects, `{"oid":"`+oid+`","size":123}`)
+		}
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:9999/objects/batch", bytes.NewBufferString(`{"operation":"`+operation+`","objects":[`+strings.Join(objects, ",")+`]}`))
+		r.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+
+		var batchResponse BatchResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batchResponse))
+
+		byOID := map[string]*BatchObjectResponse{}
+		for _, obj := range batchResponse.Objects {
+			byOID[obj.OID] = obj
+		}
+
+		return byOID
+	}
+
+	t.Run("it should pass per-object errors through", func(t *testing.T) {
+		defer negativeCache.Reset()
+
+		objects := batch("download", testOID("present"), testOID("missing"), testOID("invalid"))
+		require.Len(t, objects, 3)
+
+		assert.Equal(t, "https://this-is-from-s3.com", objects[testOID("present")].Actions["download"].Href)
+		assert.Equal(t, &BatchObjectError{Code: 404, Message: "Object does not exist"}, objects[testOID("missing")].Error)
+		assert.Equal(t, &BatchObjectError{Code: 422, Message: "Invalid object"}, objects[testOID("invalid")].Error)
+	})
+
+	t.Run("it should answer missing objects from the negative cache", func(t *testing.T) {
+		defer negativeCache.Reset()
+
+		batch("download", testOID("missing"), testOID("invalid"))
+		requested.Store(0)
+
+		objects := batch("download", testOID("missing"))
+		assert.Equal(t, int32(0), requested.Load())
+		assert.Equal(t, 404, objects[testOID("missing")].Error.Code)
+
+		// Only missing objects are cached
+		batch("download", testOID("invalid"))
+		assert.Equal(t, int32(1), requested.Load())
+	})
+
+	t.Run("it should forget missing objects being uploaded", func(t *testing.T) {
+		defer negativeCache.Reset()
+
+		batch("download", testOID("missing"))
+		assert.True(t, negativeCache.Has(testNamespace+testOID("missing")))
+
+		batch("upload", testOID("missing"))
+		assert.False(t, negativeCache.Has(testNamespace+testOID("missing")))
+	})
 
-		assert.Equal(t, expected, string(b))
+	t.Run("it should answer batches with errors only", func(t *testing.T) {
+		defer negativeCache.Reset()
 
-		assert.Equal(t, false, mockAWSService.uploadCalled)
+		objects := batch("download", testOID("invalid"))
+		assert.Equal(t, 422, objects[testOID("invalid")].Error.Code)
 	})
 }
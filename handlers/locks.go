@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vela-games/lfsproxy/tracing"
+)
+
+// cachedLocks is a lock listing of upstream kept on the locks cache
+type cachedLocks struct {
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+// ProxyLocks proxies the File Locking API to upstream.
+// Lock listings are cached for APP_LOCKS_CACHE_TTL when set, until a lock is created or released
+//
+// https://github.com/git-lfs/git-lfs/blob/main/docs/api/locking.md
+func (l LFSHandler) ProxyLocks(c *gin.Context) {
+	up, statusCode, err := l.resolveUpstream(c)
+	if err != nil {
+		c.AbortWithError(statusCode, err) //nolint:errcheck
+		return
+	}
+
+	cacheable := l.locksCache != nil && c.Request.Method == http.MethodGet
+
+	var key string
+	if cacheable {
+		key = l.locksCacheKey(c, up)
+
+		if data, err := l.locksCache.Get(key); err == nil {
+			var locks cachedLocks
+			if err := json.Unmarshal(data, &locks); err == nil {
+				c.Data(http.StatusOK, locks.ContentType, locks.Body)
+				return
+			}
+		}
+	}
+
+	resp, err := l.forwardToUpstream(c, up)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "error requesting upstream", "upstream", up.baseURL, "operation", "locks", "error", err)
+		c.AbortWithError(http.StatusBadGateway, err) //nolint:errcheck
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusBadGateway, err) //nolint:errcheck
+		return
+	}
+
+	for _, header := range []string{"LFS-Authenticate", "WWW-Authenticate"} {
+		if value := resp.Header.Get(header); value != "" {
+			c.Header(header, value)
+		}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		if cacheable {
+			if data, err := json.Marshal(cachedLocks{ContentType: contentType, Body: body}); err == nil {
+				l.locksCache.Set(key, data) //nolint:errcheck
+			}
+		} else if l.locksCache != nil && !strings.HasSuffix(up.path, "/verify") {
+			l.invalidateLocks(c.Request.Context(), up)
+		}
+	}
+
+	c.Data(resp.StatusCode, contentType, body)
+}
+
+// forwardToUpstream sends the request as is to the same LFS API path of upstream
+func (l LFSHandler) forwardToUpstream(c *gin.Context, up *upstream) (*http.Response, error) {
+	upstreamURL, err := url.Parse(up.baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(c, c.Request.Method, upstreamURL.Path+strings.TrimLeft(up.path, "/"), c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = c.Request.Header.Clone()
+	tracing.Inject(c.Request.Context(), req.Header)
+	// Let the transport negotiate compression so responses are never compressed twice by the gzip middleware
+	req.Header.Del("Accept-Encoding")
+	req.ContentLength = c.Request.ContentLength
+	req.Host = upstreamURL.Host
+	req.URL.Scheme = upstreamURL.Scheme
+	req.URL.Host = upstreamURL.Host
+	req.URL.RawQuery = c.Request.URL.RawQuery
+
+	return l.doUpstream(req)
+}
+
+// locksCacheKey scopes lock listings to the credential, the query and the lock generation of the repository
+func (l LFSHandler) locksCacheKey(c *gin.Context, up *upstream) string {
+	generation, _ := l.locksCache.Get(locksGenerationKey(up))
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		up.baseURL,
+		string(generation),
+		c.Request.URL.RawQuery,
+		c.GetHeader("Authorization"),
+	}, "\n")))
+
+	return "locks/" + hex.EncodeToString(sum[:])
+}
+
+// invalidateLocks starts a new lock generation for the repository so none of its cached listings are served anymore
+func (l LFSHandler) invalidateLocks(ctx context.Context, up *upstream) {
+	generation := make([]byte, 16)
+	if _, err := rand.Read(generation); err != nil {
+		return
+	}
+
+	if err := l.locksCache.Set(locksGenerationKey(up), []byte(hex.EncodeToString(generation))); err != nil {
+		slog.ErrorContext(ctx, "error invalidating cached locks", "upstream", up.baseURL, "operation", "locks", "error", err)
+	}
+}
+
+func locksGenerationKey(up *upstream) string {
+	return "locks-generation/" + up.baseURL
+}
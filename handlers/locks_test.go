@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/config"
+	"github.com/vela-games/lfsproxy/routing"
+)
+
+func TestProxyLocks(t *testing.T) {
+	routes, err := routing.NewTable([]routing.Route{
+		{Prefix: "vela-games/", Upstream: "https://fake-git-server.com/{owner}/{repo}.git/info/lfs/"},
+	})
+	require.NoError(t, err)
+
+	locksCache := NewMockCache()
+
+	lfsHandler := LFSHandler{
+		cache:         NewMockCache(),
+		locksCache:    locksCache,
+		promCollector: testCollector,
+		config:        &config.Config{UpstreamBaseURL: "https://fake-git-server.com/repository.git/info/lfs/"},
+		routes:        routes,
+	}
+
+	listings := 0
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	listLocks := func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Authorization") != "Basic allowed" {
+			resp := httpmock.NewStringResponse(401, `{"message":"credentials needed"}`)
+			resp.Header.Set("LFS-Authenticate", `Basic realm="Git LFS"`)
+			return resp, nil
+		}
+
+		listings++
+		resp, err := httpmock.NewJsonResponse(200, map[string]interface{}{
+			"locks": []map[string]interface{}{{"id": "some-uuid", "path": req.URL.Query().Get("path")}},
+		})
+		resp.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		return resp, err
+	}
+
+	echo := func(status int) httpmock.Responder {
+		return func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			resp := httpmock.NewBytesResponse(status, body)
+			resp.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+			return resp, nil
+		}
+	}
+
+	httpmock.RegisterResponder("GET", "https://fake-git-server.com/repository.git/info/lfs/locks", listLocks)
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/info/lfs/locks", echo(201))
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/info/lfs/locks/verify", echo(200))
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/info/lfs/locks/some-uuid/unlock", echo(200))
+	httpmock.RegisterResponder("GET", "https://fake-git-server.com/vela-games/game.git/info/lfs/locks", listLocks)
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.GET("/locks", lfsHandler.ProxyLocks)
+	r.POST("/locks", lfsHandler.ProxyLocks)
+	r.POST("/locks/verify", lfsHandler.ProxyLocks)
+	r.POST("/locks/:id/unlock", lfsHandler.ProxyLocks)
+	r.GET("/:owner/:repo/info/lfs/locks", lfsHandler.ProxyLocks)
+
+	do := func(method string, path string, body string, authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "http://localhost:9999"+path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		req.Header.Set("Authorization", authorization)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("it should proxy lock listings with their query", func(t *testing.T) {
+		defer locksCache.Reset()
+
+		w := do("GET", "/locks?path=Content/Map.umap", "", "Basic allowed")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "application/vnd.git-lfs+json", w.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"locks":[{"id":"some-uuid","path":"Content/Map.umap"}]}`, w.Body.String())
+	})
+
+	t.Run("it should pass authorization failures through", func(t *testing.T) {
+		defer locksCache.Reset()
+
+		w := do("GET", "/locks", "", "")
+		assert.Equal(t, 401, w.Code)
+		assert.Equal(t, `Basic realm="Git LFS"`, w.Header().Get("LFS-Authenticate"))
+	})
+
+	t.Run("it should proxy lock, verify and unlock requests", func(t *testing.T) {
+		defer locksCache.Reset()
+
+		w := do("POST", "/locks", `{"path":"Content/Map.umap"}`, "Basic allowed")
+		assert.Equal(t, 201, w.Code)
+		assert.JSONEq(t, `{"path":"Content/Map.umap"}`, w.Body.String())
+
+		w = do("POST", "/locks/verify", `{"limit":100}`, "Basic allowed")
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, `{"limit":100}`, w.Body.String())
+
+		w = do("POST", "/locks/some-uuid/unlock", `{"force":true}`, "Basic allowed")
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, `{"force":true}`, w.Body.String())
+	})
+
+	t.Run("it should cache lock listings per credential until locks change", func(t *testing.T) {
+		defer locksCache.Reset()
+		listings = 0
+
+		assert.Equal(t, 200, do("GET", "/locks", "", "Basic allowed").Code)
+		assert.Equal(t, 200, do("GET", "/locks", "", "Basic allowed").Code)
+		assert.Equal(t, 1, listings)
+
+		assert.Equal(t, 401, do("GET", "/locks", "", "Basic other").Code)
+
+		assert.Equal(t, 200, do("POST", "/locks/verify", `{}`, "Basic allowed").Code)
+		assert.Equal(t, 200, do("GET", "/locks", "", "Basic allowed").Code)
+		assert.Equal(t, 1, listings)
+
+		assert.Equal(t, 201, do("POST", "/locks", `{"path":"Content/Map.umap"}`, "Basic allowed").Code)
+		assert.Equal(t, 200, do("GET", "/locks", "", "Basic allowed").Code)
+		assert.Equal(t, 2, listings)
+	})
+
+	t.Run("it should proxy locks of routed repositories", func(t *testing.T) {
+		defer locksCache.Reset()
+
+		w := do("GET", "/vela-games/game.git/info/lfs/locks?path=Game.uproject", "", "Basic allowed")
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, `{"locks":[{"id":"some-uuid","path":"Game.uproject"}]}`, w.Body.String())
+	})
+
+	t.Run("it should not cache lock listings when disabled", func(t *testing.T) {
+		lfsHandler.locksCache = nil
+		defer func() { lfsHandler.locksCache = locksCache }()
+
+		_, r := gin.CreateTestContext(httptest.NewRecorder())
+		r.GET("/locks", lfsHandler.ProxyLocks)
+		listings = 0
+
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://localhost:9999/locks", nil)
+			req.Header.Set("Authorization", "Basic allowed")
+			r.ServeHTTP(w, req)
+			assert.Equal(t, 200, w.Code)
+		}
+
+		assert.Equal(t, 2, listings)
+	})
+}
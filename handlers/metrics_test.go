@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jarcoal/httpmock"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/config"
+)
+
+// metricValue reads the value of a metric of testCollector, the sample count of histograms
+func metricValue(t *testing.T, name string, labels ...string) float64 {
+	families, err := stdprometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for i := 0; i < len(labels); i += 2 {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == labels[i] && label.GetValue() != labels[i+1] {
+						continue metrics
+					}
+				}
+			}
+
+			switch {
+			case metric.GetCounter() != nil:
+				return metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				return metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestLFSHandlerMetrics(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL: "https://fake-git-server.com/repository.git/",
+		CacheEviction:   1 * time.Minute,
+	}
+
+	cache := NewMockCache()
+	mockObjectStore := MockObjectStore{
+		urls:         map[string]string{testNamespace + testOID("stored"): "https://this-is-from-s3.com"},
+		uploadCalled: &atomic.Bool{},
+	}
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        cfg,
+		objectStore:   mockObjectStore,
+	}
+	startFillQueue(t, &lfsHandler)
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	upstreamStatus := 200
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/objects/batch",
+		func(req *http.Request) (*http.Response, error) {
+			return httpmock.NewJsonResponse(upstreamStatus, map[string]interface{}{
+				"transfer": "basic",
+				"objects": []map[string]interface{}{
+					{"oid": testOID("stored"), "size": 100, "actions": map[string]interface{}{"download": map[string]interface{}{"href": "https://upstream-storage.com/stored"}}},
+					{"oid": testOID("missing"), "size": 7, "actions": map[string]interface{}{"download": map[string]interface{}{"href": "https://upstream-storage.com/missing"}}},
+				},
+			})
+		},
+	)
+	httpmock.RegisterResponder("GET", "https://upstream-storage.com/missing", httpmock.NewStringResponder(200, "content"))
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+
+	batch := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:9999/objects/batch", bytes.NewBufferString(`{"operation":"download","objects":[{"oid":"`+testOID("stored")+`","size":100},{"oid":"`+testOID("missing")+`","size":7}]}`))
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("it should count the bytes served by the object store and filled from upstream", func(t *testing.T) {
+		defer cache.Reset()
+
+		served := metricValue(t, "lfsproxy_served_bytes")
+		filled := metricValue(t, "lfsproxy_filled_bytes")
+
+		require.Equal(t, 200, batch())
+		assert.Equal(t, served+100, metricValue(t, "lfsproxy_served_bytes"))
+
+		assert.Eventually(t, func() bool {
+			return metricValue(t, "lfsproxy_filled_bytes") == filled+7 && cache.Has(testNamespace+testOID("missing"))
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, float64(0), metricValue(t, "lfsproxy_fills_in_flight"))
+
+		// Both objects are now cached and served by the object store
+		require.Equal(t, 200, batch())
+		assert.Equal(t, served+207, metricValue(t, "lfsproxy_served_bytes"))
+	})
+
+	t.Run("it should observe the latency of batches, upstream and the object store", func(t *testing.T) {
+		defer cache.Reset()
+
+		batches := metricValue(t, "lfsproxy_batch_duration_seconds", "operation", "download")
+		upstream := metricValue(t, "lfsproxy_upstream_duration_seconds")
+		heads := metricValue(t, "lfsproxy_store_duration_seconds", "operation", "head")
+		presigns := metricValue(t, "lfsproxy_store_duration_seconds", "operation", "presign")
+
+		require.Equal(t, 200, batch())
+
+		assert.Equal(t, batches+1, metricValue(t, "lfsproxy_batch_duration_seconds", "operation", "download"))
+		assert.Equal(t, upstream+1, metricValue(t, "lfsproxy_upstream_duration_seconds"))
+		assert.Equal(t, heads+2, metricValue(t, "lfsproxy_store_duration_seconds", "operation", "head"))
+		// The fill of the missing object signs its download once stored
+		assert.Eventually(t, func() bool {
+			return metricValue(t, "lfsproxy_store_duration_seconds", "operation", "presign") == presigns+2 && cache.Has(testNamespace+testOID("missing"))
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should count upstream responses by status code", func(t *testing.T) {
+		defer cache.Reset()
+
+		upstreamStatus = 502
+		defer func() { upstreamStatus = 200 }()
+
+		failures := metricValue(t, "lfsproxy_upstream_response", "code", "502")
+
+		require.Equal(t, 502, batch())
+		assert.Equal(t, failures+1, metricValue(t, "lfsproxy_upstream_response", "code", "502"))
+	})
+}
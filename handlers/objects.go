@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vela-games/lfsproxy/services"
+)
+
+// GetObject serves objects stored by backends that can't hand out presigned URLs (such as fs)
+// using the signed hrefs returned on batch responses. It answers both GET and HEAD requests,
+// and honors Range, If-Range and the other conditional headers so interrupted downloads can be resumed
+func (l LFSHandler) GetObject(c *gin.Context) {
+	key := c.Param("key")
+
+	if l.signer == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := l.signer.Verify("/objects"+key, c.Request.URL.Query()); err != nil {
+		c.AbortWithError(http.StatusForbidden, err) //nolint:errcheck
+		return
+	}
+
+	if path.Clean(key) != key || !validOID(path.Base(key)) {
+		abortWithLFSError(c, http.StatusUnprocessableEntity, "invalid object key")
+		return
+	}
+
+	for _, store := range l.allObjectStores() {
+		opener, ok := store.(services.ObjectOpener)
+		if !ok {
+			continue
+		}
+
+		body, info, err := opener.OpenOID(c, key[1:])
+		if errors.Is(err, services.ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			slog.ErrorContext(c.Request.Context(), "error opening object", "key", key[1:], "error", err)
+			c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+			return
+		}
+		defer body.Close()
+
+		if hinter, ok := body.(services.RangeHinter); ok {
+			if start, end, ok := singleRange(c.GetHeader("Range")); ok {
+				hinter.HintRange(start, end)
+			}
+		}
+
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("ETag", objectETag(path.Base(key)))
+		http.ServeContent(c.Writer, c.Request, "", info.ModTime, body)
+		return
+	}
+
+	l.redirectObject(c, key[1:])
+}
+
+// singleRange returns the bounds of a Range header asking for a single range with both ends set, the end excluded.
+// Other ranges read up to the end of the object
+func singleRange(header string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+
+	return start, end + 1, true
+}
+
+// objectETag returns the ETag of an object. Objects are content-addressed, so their oid is a strong validator
+// clients can resume downloads against with If-Range, whatever store or replica serves them
+func objectETag(oid string) string {
+	return `"` + oid + `"`
+}
+
+// redirectObject sends clients to wherever the store keeps an object no longer served by the proxy,
+// such as the durable tier for objects evicted from the disk cache
+func (l LFSHandler) redirectObject(c *gin.Context, oid string) {
+	for _, store := range l.allObjectStores() {
+		redirector, ok := store.(services.ObjectRedirector)
+		if !ok {
+			continue
+		}
+
+		exists, err := store.OIDExists(oid)
+		if err != nil || !exists {
+			continue
+		}
+
+		urlStr, err := redirector.RedirectURL(oid)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "error redirecting object", "key", oid, "error", err)
+			c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+			return
+		}
+
+		c.Redirect(http.StatusFound, urlStr)
+		return
+	}
+
+	c.AbortWithStatus(http.StatusNotFound)
+}
+
+// allObjectStores returns the default object store followed by the ones of the buckets overridden by routes
+func (l LFSHandler) allObjectStores() []services.ObjectStore {
+	stores := []services.ObjectStore{l.objectStore}
+	for _, store := range l.bucketStores {
+		stores = append(stores, store)
+	}
+
+	return stores
+}
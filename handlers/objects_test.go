@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/config"
+	"github.com/vela-games/lfsproxy/services"
+)
+
+func TestGetObject(t *testing.T) {
+	oid := "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	signer := services.NewHrefSigner("http://localhost:9999", []byte("secret"), 1*time.Hour)
+
+	fs, err := services.NewFSService(t.TempDir(), signer)
+	require.NoError(t, err)
+	require.NoError(t, fs.UploadOID(oid, io.NopCloser(bytes.NewBufferString("0123456789"))))
+
+	lfsHandler := LFSHandler{
+		cache:         NewMockCache(),
+		promCollector: testCollector,
+		config:        &config.Config{},
+		objectStore:   fs,
+		signer:        signer,
+	}
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.GET("/objects/*key", lfsHandler.GetObject)
+	r.HEAD("/objects/*key", lfsHandler.GetObject)
+
+	href, _, err := fs.GetOIDPreSignedURL(oid)
+	require.NoError(t, err)
+
+	t.Run("it should serve signed hrefs", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", href, nil)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "0123456789", w.Body.String())
+		assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("it should answer HEAD requests", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("HEAD", href, nil)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "10", w.Header().Get("Content-Length"))
+	})
+
+	t.Run("it should serve ranges", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", href, nil)
+		req.Header.Set("Range", "bytes=5-")
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 206, w.Code)
+		assert.Equal(t, "56789", w.Body.String())
+	})
+
+	t.Run("it should resume downloads of the same object", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", href, nil)
+		r.ServeHTTP(w, req)
+		etag := w.Header().Get("ETag")
+		assert.Equal(t, `"`+oid+`"`, etag)
+		assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", href, nil)
+		req.Header.Set("Range", "bytes=5-")
+		req.Header.Set("If-Range", etag)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 206, w.Code)
+		assert.Equal(t, "56789", w.Body.String())
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", href, nil)
+		req.Header.Set("Range", "bytes=5-")
+		req.Header.Set("If-Range", `"another-etag"`)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "0123456789", w.Body.String())
+	})
+
+	t.Run("it should reject unsigned requests", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost:9999/objects/"+oid, nil)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	t.Run("it should not serve other objects with a valid signature", func(t *testing.T) {
+		u, _ := url.Parse(href)
+		u.Path = "/objects/0000000000000000000000000000000000000000000000000000000000000000"
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", u.String(), nil)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 403, w.Code)
+	})
+
+	t.Run("it should return 404 for missing objects", func(t *testing.T) {
+		missing := "0000000000000000000000000000000000000000000000000000000000000000"
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", signer.Sign("/objects/"+missing), nil)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 404, w.Code)
+	})
+	t.Run("it should reject keys that aren't objects", func(t *testing.T) {
+		for _, key := range []string{"abc", "fake-git-server.com/secret.git/../" + oid, strings.ToUpper(oid)} {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", signer.Sign("/objects/"+key), nil)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, 422, w.Code, key)
+		}
+	})
+}
+
+func TestSingleRange(t *testing.T) {
+	t.Run("it should bound single ranges with both ends", func(t *testing.T) {
+		start, end, ok := singleRange("bytes=5-9")
+		assert.True(t, ok)
+		assert.Equal(t, int64(5), start)
+		assert.Equal(t, int64(10), end)
+	})
+
+	t.Run("it should leave other ranges unbounded", func(t *testing.T) {
+		for _, header := range []string{"", "bytes=5-", "bytes=-5", "bytes=0-1,5-9", "bytes=9-5", "items=0-1"} {
+			_, _, ok := singleRange(header)
+			assert.False(t, ok, header)
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vela-games/lfsproxy/logging"
+	"github.com/vela-games/lfsproxy/services"
+)
+
+// pendingTee is an object missing from the object store, waiting for the client to download it through the proxy.
+// Pending tees are sealed into the hrefs handed out to the client, like pending uploads
+type pendingTee struct {
+	UpstreamBaseURL string              `json:"upstream_base_url"`
+	Bucket          string              `json:"bucket,omitempty"`
+	KeyPrefix       string              `json:"key_prefix,omitempty"`
+	Object          BatchObjectResponse `json:"object"`
+}
+
+// interceptDownload records the upstream download action of an object missing from the object store
+// and returns the download action pointing the client to the proxy instead, see GetTee
+func (l LFSHandler) interceptDownload(up *upstream, obj BatchObjectResponse) (*BatchObjectActionResponse, error) {
+	expiration := actionExpiration(l.config.ProxyHrefExpiration, obj.Actions["download"])
+	if expiration < time.Second {
+		return nil, errors.New("upstream download href expired")
+	}
+
+	data, err := json.Marshal(pendingTee{
+		UpstreamBaseURL: up.baseURL,
+		Bucket:          up.bucket,
+		KeyPrefix:       up.keyPrefix,
+		Object:          obj,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := l.signer.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BatchObjectActionResponse{
+		Href:      l.signer.SignFor("/tee/"+id, expiration),
+		ExpiresIn: int(expiration.Seconds()),
+	}, nil
+}
+
+// actionExpiration keeps hrefs to the proxy from outliving the upstream action they stand in for
+func actionExpiration(expiration time.Duration, action *BatchObjectActionResponse) time.Duration {
+	if action == nil {
+		return expiration
+	}
+
+	if expiresIn := time.Duration(action.ExpiresIn) * time.Second; expiresIn > 0 && expiresIn < expiration {
+		expiration = expiresIn
+	}
+
+	if !action.ExpiresAt.IsZero() {
+		if until := time.Until(action.ExpiresAt); until < expiration {
+			expiration = until
+		}
+	}
+
+	return expiration
+}
+
+// GetTee serves an object missing from the object store by downloading it from upstream once
+// and streaming it to the client and to the object store at the same time
+func (l LFSHandler) GetTee(c *gin.Context) {
+	id := c.Param("id")
+
+	if l.signer == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := l.signer.Verify("/tee/"+id, c.Request.URL.Query()); err != nil {
+		c.AbortWithError(http.StatusForbidden, err) //nolint:errcheck
+		return
+	}
+
+	data, err := l.signer.Open(id)
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err) //nolint:errcheck
+		return
+	}
+
+	var tee pendingTee
+	if err := json.Unmarshal(data, &tee); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+		return
+	}
+
+	up := l.newUpstream(tee.UpstreamBaseURL, tee.Bucket, tee.KeyPrefix, "")
+	obj := tee.Object
+
+	ctx := logging.With(c.Request.Context(), slog.String("operation", "tee"))
+	c.Request = c.Request.WithContext(ctx)
+
+	etag := objectETag(obj.OID)
+	c.Header("ETag", etag)
+	c.Header("Accept-Ranges", "bytes")
+
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("Content-Length", strconv.FormatInt(obj.Size, 10))
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// Ranges of another version of the object are answered with the whole object
+	byteRange := c.GetHeader("Range")
+	if ifRange := c.GetHeader("If-Range"); ifRange != "" && ifRange != etag {
+		byteRange = ""
+	}
+
+	// Resumed downloads are served by the object store once the object is there,
+	// and passed through otherwise since only complete objects can be stored
+	if byteRange != "" {
+		if !l.redirectToStore(c, up, obj.OID) {
+			l.passThrough(c, obj, byteRange)
+		}
+		return
+	}
+
+	// Downloads of an object already being filled are passed through instead of waiting for the fill
+	if l.fills.Running(up.cacheKey(obj.OID)) {
+		if !l.redirectToStore(c, up, obj.OID) {
+			l.passThrough(c, obj, "")
+		}
+		return
+	}
+
+	teed := false
+	_, err, _ = l.fills.Do(up.cacheKey(obj.OID), func() (interface{}, error) {
+		exists, err := up.objectStore.OIDExists(obj.OID)
+		if err != nil || exists {
+			return nil, err
+		}
+
+		release, err := l.leaseFill(ctx, up, obj.OID)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		teed = true
+		return nil, l.tee(c, up, obj)
+	})
+
+	if teed {
+		if err != nil {
+			slog.ErrorContext(ctx, "error streaming object from upstream", "oid", obj.OID, "error", err)
+		}
+		return
+	}
+
+	if errors.Is(err, errFillLeased) {
+		// Queue a fill that waits for the other replica, and takes over when it fails to store the object
+		l.enqueueFill(ctx, up, obj)
+	} else if err != nil {
+		slog.ErrorContext(ctx, "error checking object", "oid", obj.OID, "error", err)
+	}
+
+	// Someone else filled the object while we waited, or is filling it on another replica
+	if !l.redirectToStore(c, up, obj.OID) {
+		l.passThrough(c, obj, "")
+	}
+}
+
+// redirectToStore sends the client to the object store when it holds the object
+func (l LFSHandler) redirectToStore(c *gin.Context, up *upstream, oid string) bool {
+	exists, err := up.objectStore.OIDExists(oid)
+	if err != nil || !exists {
+		return false
+	}
+
+	url, _, err := up.objectStore.GetOIDPreSignedURL(oid)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "error signing download", "oid", oid, "error", err)
+		return false
+	}
+
+	c.Redirect(http.StatusFound, url)
+
+	return true
+}
+
+// tee streams an object from upstream to the client and the object store. The object store keeps reading
+// when the client goes away, and the client keeps reading when the object store fails.
+// Objects that can't be stored are queued for a regular fill
+func (l LFSHandler) tee(c *gin.Context, up *upstream, obj BatchObjectResponse) error {
+	// The upstream download must outlive the client so the object store gets the whole object
+	ctx := context.WithoutCancel(c.Request.Context())
+
+	l.promCollector.FillsInFlight.Add(1)
+	defer l.promCollector.FillsInFlight.Add(-1)
+
+	resp, err := l.downloadFromUpstream(ctx, obj, "")
+	if err != nil {
+		abortWithLFSError(c, http.StatusBadGateway, "error downloading object from upstream")
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		abortWithLFSError(c, http.StatusBadGateway, "error downloading object from upstream")
+		return fmt.Errorf("error downloading %v from upstream: %v", obj.OID, resp.Status)
+	}
+
+	pr, pw := io.Pipe()
+	stored := make(chan error, 1)
+	go func() {
+		err := l.pushToS3(ctx, up, obj, services.NewVerifyingReader(pr, obj.OID, obj.Size))
+		// Unblock the writes left when the object store stops reading early
+		pr.CloseWithError(err) //nolint:errcheck
+		stored <- err
+	}()
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Length", strconv.FormatInt(obj.Size, 10))
+	c.Status(http.StatusOK)
+
+	var storeErr, clientErr, readErr error
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if storeErr == nil {
+				_, storeErr = pw.Write(buf[:n])
+			}
+			if clientErr == nil {
+				_, clientErr = c.Writer.Write(buf[:n])
+			}
+			if storeErr != nil && clientErr != nil {
+				readErr = clientErr
+				break
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			readErr = err
+			break
+		}
+	}
+
+	pw.CloseWithError(readErr) //nolint:errcheck
+	err = <-stored
+
+	if err != nil && !errors.Is(err, services.ErrContentMismatch) {
+		l.enqueueFill(ctx, up, obj)
+	}
+
+	return err
+}
+
+// passThrough streams an object, or a range of it, from upstream to the client without storing it
+func (l LFSHandler) passThrough(c *gin.Context, obj BatchObjectResponse, byteRange string) {
+	resp, err := l.downloadFromUpstream(c, obj, byteRange)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "error downloading object from upstream", "oid", obj.OID, "error", err)
+		abortWithLFSError(c, http.StatusBadGateway, "error downloading object from upstream")
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range []string{"Content-Length", "Content-Range", "Accept-Ranges"} {
+		if value := resp.Header.Get(header); value != "" {
+			c.Header(header, value)
+		}
+	}
+
+	c.DataFromReader(resp.StatusCode, -1, "application/octet-stream", resp.Body, nil)
+}
+
+// downloadFromUpstream sends a request to the upstream download action of an object
+func (l LFSHandler) downloadFromUpstream(ctx context.Context, obj BatchObjectResponse, byteRange string) (*http.Response, error) {
+	download, ok := obj.Actions["download"]
+	if !ok {
+		return nil, errors.New("no download action")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", download.Href, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range download.Header {
+		req.Header.Set(key, value)
+	}
+
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	return http.DefaultClient.Do(req)
+}
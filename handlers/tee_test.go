@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/config"
+	"github.com/vela-games/lfsproxy/services"
+)
+
+func TestTeeStreaming(t *testing.T) {
+	// sha256 of "0123456789"
+	oid := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+	cfg := &config.Config{
+		UpstreamBaseURL:     "https://fake-git-server.com/repository.git/",
+		TeeStreamingEnabled: true,
+		ProxyHrefExpiration: 1 * time.Hour,
+	}
+
+	signer := services.NewHrefSigner("http://localhost:9999", []byte("secret"), cfg.ProxyHrefExpiration)
+
+	fs, err := services.NewFSService(t.TempDir(), signer)
+	require.NoError(t, err)
+
+	cache := NewMockCache()
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		fills:         &fillGroup{},
+		promCollector: testCollector,
+		config:        cfg,
+		objectStore:   fs,
+		signer:        signer,
+	}
+	startFillQueue(t, &lfsHandler)
+
+	var downloads atomic.Int32
+	content := "0123456789"
+	expiresIn := 0
+	// firstDownload holds the first download from upstream until it's closed, when set
+	var firstDownload chan struct{}
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/objects/batch",
+		func(req *http.Request) (*http.Response, error) {
+			return httpmock.NewJsonResponse(200, map[string]interface{}{
+				"transfer": "basic",
+				"objects": []map[string]interface{}{
+					{
+						"oid":  oid,
+						"size": 10,
+						"actions": map[string]interface{}{
+							"download": map[string]interface{}{
+								"href":       "https://upstream-storage.com/" + oid,
+								"header":     map[string]interface{}{"Authorization": "Bearer download-token"},
+								"expires_in": expiresIn,
+							},
+						},
+					},
+				},
+			})
+		},
+	)
+
+	httpmock.RegisterResponder("GET", "https://upstream-storage.com/"+oid,
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Authorization") != "Bearer download-token" {
+				return httpmock.NewStringResponse(401, ""), nil
+			}
+
+			if downloads.Add(1) == 1 && firstDownload != nil {
+				<-firstDownload
+			}
+
+			if byteRange := req.Header.Get("Range"); byteRange != "" {
+				resp := httpmock.NewStringResponse(206, content[5:])
+				resp.Header.Set("Content-Range", "bytes 5-9/10")
+				return resp, nil
+			}
+
+			return httpmock.NewStringResponse(200, content), nil
+		},
+	)
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+	r.GET("/tee/:id", lfsHandler.GetTee)
+	r.HEAD("/tee/:id", lfsHandler.GetTee)
+
+	do := func(method string, url string, body string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		for key := range header {
+			req.Header.Set(key, header.Get(key))
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	batch := func() *BatchObjectActionResponse {
+		w := do("POST", "http://localhost:9999/objects/batch", `{"operation":"download","objects":[{"oid":"`+oid+`","size":10}]}`, nil)
+		require.Equal(t, 200, w.Code)
+
+		var batchResponse BatchResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batchResponse))
+		require.Len(t, batchResponse.Objects, 1)
+
+		return batchResponse.Objects[0].Actions["download"]
+	}
+
+	reset := func() {
+		cache.Reset()
+		require.NoError(t, fs.Remove(testNamespace+oid))
+		downloads.Store(0)
+		content = "0123456789"
+	}
+
+	t.Run("it should stream missing objects to the client and the object store with one download", func(t *testing.T) {
+		defer reset()
+
+		download := batch()
+		assert.Contains(t, download.Href, "http://localhost:9999/tee/")
+		assert.Empty(t, download.Header)
+		assert.Equal(t, 3600, download.ExpiresIn)
+
+		// As if the object was downloaded from another replica
+		cache.Reset()
+
+		w := do("GET", download.Href, "", nil)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "0123456789", w.Body.String())
+		assert.Equal(t, int32(1), downloads.Load())
+
+		exists, err := fs.OIDExists(testNamespace + oid)
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		// The object is now served by the object store
+		assert.Contains(t, batch().Href, "http://localhost:9999/objects/")
+		assert.Equal(t, int32(1), downloads.Load())
+	})
+
+	t.Run("it should not hand out hrefs outliving the upstream download", func(t *testing.T) {
+		defer reset()
+
+		expiresIn = 600
+		defer func() { expiresIn = 0 }()
+
+		download := batch()
+		assert.Contains(t, download.Href, "http://localhost:9999/tee/")
+		assert.LessOrEqual(t, download.ExpiresIn, 600)
+		assert.Greater(t, download.ExpiresIn, 590)
+
+		// Nor signatures outliving it
+		u, err := url.Parse(download.Href)
+		require.NoError(t, err)
+		expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, expires, time.Now().Add(600*time.Second).Unix())
+	})
+
+	t.Run("it should pass concurrent downloads through while the object is filled", func(t *testing.T) {
+		defer reset()
+
+		firstDownload = make(chan struct{})
+		defer func() { firstDownload = nil }()
+
+		download := batch()
+
+		teed := make(chan *httptest.ResponseRecorder)
+		go func() { teed <- do("GET", download.Href, "", nil) }()
+
+		require.Eventually(t, func() bool {
+			return lfsHandler.fills.Running(testNamespace + oid)
+		}, 1*time.Second, 10*time.Millisecond)
+
+		w := do("GET", download.Href, "", nil)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "0123456789", w.Body.String())
+		assert.Equal(t, int32(2), downloads.Load())
+
+		close(firstDownload)
+		assert.Equal(t, 200, (<-teed).Code)
+
+		exists, err := fs.OIDExists(testNamespace + oid)
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("it should redirect to the object store once the object is filled", func(t *testing.T) {
+		defer reset()
+
+		download := batch()
+		require.NoError(t, fs.UploadOID(testNamespace+oid, httpmock.NewRespBodyFromString("0123456789")))
+
+		w := do("GET", download.Href, "", nil)
+		assert.Equal(t, 302, w.Code)
+		assert.Contains(t, w.Header().Get("Location"), "http://localhost:9999/objects/")
+		assert.Equal(t, int32(0), downloads.Load())
+	})
+
+	t.Run("it should not store corrupted objects", func(t *testing.T) {
+		defer reset()
+
+		content = "0123456780"
+
+		w := do("GET", batch().Href, "", nil)
+		assert.Equal(t, 200, w.Code)
+
+		exists, err := fs.OIDExists(testNamespace + oid)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("it should pass resumed downloads through", func(t *testing.T) {
+		defer reset()
+
+		w := do("GET", batch().Href, "", http.Header{"Range": []string{"bytes=5-"}})
+		assert.Equal(t, 206, w.Code)
+		assert.Equal(t, "56789", w.Body.String())
+		assert.Equal(t, "bytes 5-9/10", w.Header().Get("Content-Range"))
+
+		exists, err := fs.OIDExists(testNamespace + oid)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("it should answer HEAD requests without downloading", func(t *testing.T) {
+		defer reset()
+
+		w := do("HEAD", batch().Href, "", nil)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "10", w.Header().Get("Content-Length"))
+		assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+		assert.Equal(t, `"`+oid+`"`, w.Header().Get("ETag"))
+		assert.Equal(t, int32(0), downloads.Load())
+	})
+
+	t.Run("it should stream the whole object for ranges of another version", func(t *testing.T) {
+		defer reset()
+
+		w := do("GET", batch().Href, "", http.Header{"Range": []string{"bytes=5-"}, "If-Range": []string{`"another-etag"`}})
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "0123456789", w.Body.String())
+
+		exists, err := fs.OIDExists(testNamespace + oid)
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("it should resume downloads from the object store once filled", func(t *testing.T) {
+		defer reset()
+
+		download := batch()
+		require.NoError(t, fs.UploadOID(testNamespace+oid, httpmock.NewRespBodyFromString("0123456789")))
+
+		w := do("GET", download.Href, "", http.Header{"Range": []string{"bytes=5-"}, "If-Range": []string{`"` + oid + `"`}})
+		assert.Equal(t, 302, w.Code)
+		assert.Contains(t, w.Header().Get("Location"), "http://localhost:9999/objects/")
+		assert.Equal(t, int32(0), downloads.Load())
+	})
+
+	t.Run("it should reject unsigned downloads", func(t *testing.T) {
+		defer reset()
+
+		batch()
+
+		assert.Equal(t, 403, do("GET", "http://localhost:9999/tee/some-id", "", nil).Code)
+	})
+
+	t.Run("it should point clients to upstream when disabled", func(t *testing.T) {
+		defer reset()
+
+		cfg.TeeStreamingEnabled = false
+		defer func() { cfg.TeeStreamingEnabled = true }()
+
+		assert.Equal(t, "https://upstream-storage.com/"+oid, batch().Href)
+
+		// The fill happens in the background instead
+		assert.Eventually(t, func() bool {
+			exists, err := fs.OIDExists(testNamespace + oid)
+			return err == nil && exists
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/config"
+	"github.com/vela-games/lfsproxy/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestExporter records the spans of the test in memory
+func newTestExporter(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	tracing.SetPropagator()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return exporter
+}
+
+func spansNamed(spans tracetest.SpanStubs, name string) tracetest.SpanStubs {
+	var named tracetest.SpanStubs
+	for _, span := range spans {
+		if span.Name == name {
+			named = append(named, span)
+		}
+	}
+
+	return named
+}
+
+func TestLFSHandlerTracing(t *testing.T) {
+	exporter := newTestExporter(t)
+
+	cfg := &config.Config{
+		UpstreamBaseURL: "https://fake-git-server.com/repository.git/",
+		CacheEviction:   1 * time.Minute,
+	}
+
+	cache := NewMockCache()
+	mockObjectStore := MockObjectStore{
+		urls:         map[string]string{testNamespace + testOID("stored"): "https://this-is-from-s3.com"},
+		uploadCalled: &atomic.Bool{},
+	}
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		promCollector: testCollector,
+		fills:         &fillGroup{},
+		config:        cfg,
+		objectStore:   mockObjectStore,
+	}
+	startFillQueue(t, &lfsHandler)
+
+	require.NoError(t, cache.Set(testNamespace+testOID("cached"), []byte(`{"oid":"`+testOID("cached")+`","size":123,"actions":{"download":{"href":"https://cached-download.com"}}}`)))
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var upstreamTraceparent string
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/objects/batch",
+		func(req *http.Request) (*http.Response, error) {
+			upstreamTraceparent = req.Header.Get("traceparent")
+
+			return httpmock.NewJsonResponse(200, map[string]interface{}{
+				"transfer": "basic",
+				"objects": []map[string]interface{}{
+					{"oid": testOID("stored"), "size": 123, "actions": map[string]interface{}{"download": map[string]interface{}{"href": "https://upstream-storage.com/stored"}}},
+					{"oid": testOID("missing"), "size": 123, "actions": map[string]interface{}{"download": map[string]interface{}{"href": "https://upstream-storage.com/missing"}}},
+				},
+			})
+		},
+	)
+	httpmock.RegisterResponder("GET", "https://upstream-storage.com/missing", httpmock.NewStringResponder(200, "content"))
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.Use(tracing.Middleware())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://localhost:9999/objects/batch", bytes.NewBufferString(`{"operation":"download","objects":[{"oid":"`+testOID("cached")+`","size":123},{"oid":"`+testOID("stored")+`","size":123},{"oid":"`+testOID("missing")+`","size":123}]}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	r.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	// The fill is traced once it runs on the fill queue
+	assert.Eventually(t, func() bool {
+		return len(spansNamed(exporter.GetSpans(), "fill")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	spans := exporter.GetSpans()
+
+	server := spansNamed(spans, "POST /objects/batch")
+	require.Len(t, server, 1)
+
+	t.Run("it should continue the trace of the client", func(t *testing.T) {
+		assert.Equal(t, traceID, server[0].SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", server[0].Parent.SpanID().String())
+	})
+
+	t.Run("it should trace cache lookups, the upstream call and the object store", func(t *testing.T) {
+		var request tracetest.SpanStubs
+		for _, span := range spans {
+			if span.SpanContext.TraceID().String() == traceID {
+				request = append(request, span)
+			}
+		}
+
+		assert.Len(t, spansNamed(request, "cache.get"), 3)
+		assert.Len(t, spansNamed(request, "upstream.batch"), 1)
+		assert.Len(t, spansNamed(request, "store.head"), 2)
+		assert.Len(t, spansNamed(request, "store.presign"), 1)
+
+		for _, name := range []string{"cache.get", "upstream.batch", "store.head", "store.presign"} {
+			for _, span := range spansNamed(request, name) {
+				assert.Equal(t, server[0].SpanContext.SpanID(), span.Parent.SpanID(), name)
+			}
+		}
+	})
+
+	t.Run("it should propagate the trace to upstream", func(t *testing.T) {
+		upstream := spansNamed(spans, "upstream.batch")[0]
+		assert.Equal(t, "00-"+traceID+"-"+upstream.SpanContext.SpanID().String()+"-01", upstreamTraceparent)
+	})
+
+	t.Run("it should link the fill back to the batch request", func(t *testing.T) {
+		fill := spansNamed(spans, "fill")[0]
+		assert.NotEqual(t, traceID, fill.SpanContext.TraceID().String())
+		require.Len(t, fill.Links, 1)
+		assert.Equal(t, traceID, fill.Links[0].SpanContext.TraceID().String())
+
+		upload := spansNamed(spans, "store.upload")
+		require.Len(t, upload, 1)
+		assert.Equal(t, fill.SpanContext.SpanID(), upload[0].Parent.SpanID())
+		assert.True(t, mockObjectStore.uploadCalled.Load())
+	})
+}
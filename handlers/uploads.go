@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vela-games/lfsproxy/logging"
+	"github.com/vela-games/lfsproxy/queue"
+	"github.com/vela-games/lfsproxy/services"
+	"github.com/vela-games/lfsproxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// UploadModeSync completes the upload on upstream before answering the client
+	UploadModeSync = "sync"
+	// UploadModeAsync answers the client as soon as the object is stored and completes the upload on upstream in the background
+	UploadModeAsync = "async"
+)
+
+// pendingUpload is an upload upstream asked for, waiting for the client to send the object to the proxy.
+// Pending uploads are sealed into the hrefs handed out to the client rather than kept by the proxy, since the upload
+// and verify actions of upstream may hold credentials and any replica may receive the object
+type pendingUpload struct {
+	OID             string                     `json:"oid"`
+	Size            int64                      `json:"size"`
+	UpstreamBaseURL string                     `json:"upstream_base_url"`
+	Bucket          string                     `json:"bucket,omitempty"`
+	KeyPrefix       string                     `json:"key_prefix,omitempty"`
+	Upload          *BatchObjectActionResponse `json:"upload"`
+	Verify          *BatchObjectActionResponse `json:"verify,omitempty"`
+	// BatchRequestID is the batch request the upload was handed out by, carried by the log lines of the upload
+	BatchRequestID string `json:"batch_request_id,omitempty"`
+}
+
+// uploadJob is an upload waiting on the upload queue to be completed on upstream
+type uploadJob struct {
+	// Upload is the sealed pending upload, so the credentials it may hold aren't kept on disk in the clear
+	Upload string `json:"upload"`
+	// SpoolPath is the object the client sent, spooled next to the queued job
+	SpoolPath string `json:"spool_path"`
+	// Trace is the trace context of the request the object was sent on, the trace of the upload links back to it
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// newUploadQueue builds the queue uploads to upstream run on with APP_UPLOAD_MODE=async. Uploads and their spooled
+// objects are kept on APP_UPLOAD_QUEUE_DIR when set so they survive restarts
+func (l *LFSHandler) newUploadQueue() (*queue.Queue, error) {
+	if l.config.UploadQueueDir != "" {
+		if err := os.MkdirAll(l.uploadSpoolDir(), 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	return queue.New(queue.Options{
+		Dir:            l.config.UploadQueueDir,
+		Workers:        l.config.UploadQueueWorkers,
+		MaxAttempts:    l.config.FillQueueMaxAttempts,
+		InitialBackoff: l.config.FillQueueInitialBackoff,
+		MaxBackoff:     l.config.FillQueueMaxBackoff,
+		DeadRetention:  l.config.FillQueueDeadRetention,
+		OnDeadLetter: func(job *queue.Job) {
+			var upload uploadJob
+			if err := json.Unmarshal(job.Payload, &upload); err == nil {
+				os.Remove(upload.SpoolPath)
+			}
+		},
+	}, func(ctx context.Context, job *queue.Job) error {
+		return l.runUploadJob(ctx, job)
+	})
+}
+
+// uploadSpoolDir is where uploads are spooled to. Uploads completed in the background
+// are spooled next to their queued job so they survive restarts too
+func (l LFSHandler) uploadSpoolDir() string {
+	if l.config.UploadMode == UploadModeAsync && l.config.UploadQueueDir != "" {
+		return filepath.Join(l.config.UploadQueueDir, "spool")
+	}
+
+	return l.config.UploadSpoolDir
+}
+
+func (l LFSHandler) runUploadJob(ctx context.Context, job *queue.Job) (err error) {
+	var queued uploadJob
+	if err := json.Unmarshal(job.Payload, &queued); err != nil {
+		return queue.Permanent(err)
+	}
+
+	// Uploads sealed with another APP_PROXY_SIGNING_KEY can't be opened anymore
+	upload, err := l.openUpload(queued.Upload)
+	if err != nil {
+		return queue.Permanent(err)
+	}
+
+	// Upstream actions can't be renewed without the credentials of the client, so retrying an expired action is pointless
+	if job.Attempts > 0 && !upload.Upload.ExpiresAt.IsZero() && time.Now().After(upload.Upload.ExpiresAt) {
+		return queue.Permanent(fmt.Errorf("upload href of %v expired", upload.OID))
+	}
+
+	ctx = logging.With(logging.WithRequestID(ctx, job.RequestID),
+		slog.String("operation", "upload"), slog.String("batch_request_id", upload.BatchRequestID))
+	ctx, span := tracing.Link(ctx, "upload", queued.Trace, trace.WithAttributes(tracing.OID(upload.OID), attribute.Int("lfs.attempt", job.Attempts+1)))
+	defer func() { tracing.End(span, err) }()
+
+	err = l.completeUpload(ctx, upload, queued.SpoolPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// The spooled object didn't survive the restart
+		return queue.Permanent(err)
+	} else if err != nil {
+		l.promCollector.UploadFailures.With("destination", "upstream").Add(1)
+		slog.ErrorContext(ctx, "error uploading object to upstream", "oid", upload.OID, "error", err)
+		return err
+	}
+
+	os.Remove(queued.SpoolPath)
+
+	return nil
+}
+
+// sealUpload seals a pending upload into the token its hrefs are named after
+func (l LFSHandler) sealUpload(upload pendingUpload) (string, error) {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return "", err
+	}
+
+	return l.signer.Seal(data)
+}
+
+// openUpload returns the pending upload sealed into a token by sealUpload
+func (l LFSHandler) openUpload(token string) (*pendingUpload, error) {
+	data, err := l.signer.Open(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var upload pendingUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+
+	return &upload, nil
+}
+
+// postUploadBatch forwards upload batches to upstream. When uploads are enabled the upload and verify
+// actions are replaced by hrefs to the proxy, which stores the objects before completing the upload on upstream
+func (l LFSHandler) postUploadBatch(c *gin.Context, up *upstream, batchRequest BatchRequest) {
+	// The objects are about to exist on upstream
+	for _, obj := range batchRequest.Objects {
+		l.forgetObjectError(up, obj.OID)
+	}
+
+	upstreamBatchResponse, statusCode, err := l.getFromUpstream(c, up.baseURL, batchRequest, up.path, c.Request.Header)
+	if err != nil {
+		abortWithUpstreamError(c, statusCode, err)
+		return
+	}
+
+	// Other transfer adapters don't use the upload href the same way
+	transfer := upstreamBatchResponse.Transfer
+	if l.config.UploadEnabled && (transfer == "" || transfer == "basic") {
+		for _, obj := range upstreamBatchResponse.Objects {
+			if err := l.interceptUpload(c.Request.Context(), up, obj); err != nil {
+				slog.ErrorContext(c.Request.Context(), "error intercepting upload, sending it to upstream", "oid", obj.OID, "error", err)
+			}
+		}
+	}
+
+	c.JSON(200, upstreamBatchResponse)
+}
+
+// interceptUpload records the upstream actions of an object and points the client to the proxy instead.
+// Objects without an upload action are already on upstream and are left untouched
+func (l LFSHandler) interceptUpload(ctx context.Context, up *upstream, obj *BatchObjectResponse) error {
+	uploadAction, ok := obj.Actions["upload"]
+	if !ok {
+		return nil
+	}
+
+	expiration := actionExpiration(actionExpiration(l.config.ProxyHrefExpiration, uploadAction), obj.Actions["verify"])
+	if expiration < time.Second {
+		return errors.New("upstream upload href expired")
+	}
+
+	id, err := l.sealUpload(pendingUpload{
+		OID:             obj.OID,
+		Size:            obj.Size,
+		UpstreamBaseURL: up.baseURL,
+		Bucket:          up.bucket,
+		KeyPrefix:       up.keyPrefix,
+		Upload:          uploadAction,
+		Verify:          obj.Actions["verify"],
+		BatchRequestID:  logging.RequestID(ctx),
+	})
+	if err != nil {
+		return err
+	}
+
+	obj.Actions["upload"] = &BatchObjectActionResponse{
+		Href:      l.signer.SignFor("/uploads/"+id, expiration),
+		ExpiresIn: int(expiration.Seconds()),
+	}
+
+	if _, ok := obj.Actions["verify"]; ok {
+		obj.Actions["verify"] = &BatchObjectActionResponse{
+			Href:      l.signer.SignFor("/uploads/"+id+"/verify", expiration),
+			ExpiresIn: int(expiration.Seconds()),
+		}
+	}
+
+	return nil
+}
+
+// loadPendingUpload returns the upload a signed upload or verify href points to
+func (l LFSHandler) loadPendingUpload(c *gin.Context, signedPath string) (*pendingUpload, bool) {
+	if l.signer == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+
+	if err := l.signer.Verify(signedPath, c.Request.URL.Query()); err != nil {
+		c.AbortWithError(http.StatusForbidden, err) //nolint:errcheck
+		return nil, false
+	}
+
+	upload, err := l.openUpload(c.Param("id"))
+	if errors.Is(err, services.ErrHrefInvalidState) {
+		c.AbortWithError(http.StatusForbidden, err) //nolint:errcheck
+		return nil, false
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+		return nil, false
+	}
+
+	if !validOID(upload.OID) {
+		abortWithLFSError(c, http.StatusUnprocessableEntity, "invalid oid "+strconv.Quote(upload.OID))
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// PutUpload receives an object from the client, stores it and completes its upload on upstream
+// synchronously or asynchronously depending on APP_UPLOAD_MODE
+func (l LFSHandler) PutUpload(c *gin.Context) {
+	upload, ok := l.loadPendingUpload(c, "/uploads/"+c.Param("id"))
+	if !ok {
+		return
+	}
+
+	up := l.newUpstream(upload.UpstreamBaseURL, upload.Bucket, upload.KeyPrefix, "")
+
+	ctx := logging.With(c.Request.Context(), slog.String("operation", "upload"), slog.String("batch_request_id", upload.BatchRequestID))
+	c.Request = c.Request.WithContext(ctx)
+
+	// The object is spooled to disk since it is read twice, once by the object store and once by upstream
+	spool, err := os.CreateTemp(l.uploadSpoolDir(), "lfsproxy-upload-")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+		return
+	}
+	spoolPath := spool.Name()
+
+	_, err = io.Copy(spool, services.NewVerifyingReader(c.Request.Body, upload.OID, upload.Size))
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, services.ErrContentMismatch) {
+		os.Remove(spoolPath)
+		l.promCollector.VerificationFailures.Add(1)
+		abortWithLFSError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	} else if err != nil {
+		os.Remove(spoolPath)
+		c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+		return
+	}
+
+	body, err := os.Open(spoolPath)
+	if err != nil {
+		os.Remove(spoolPath)
+		c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+		return
+	}
+
+	if err := l.storeObject(ctx, up, upload.OID, upload.Size, body); err != nil {
+		os.Remove(spoolPath)
+		slog.ErrorContext(ctx, "error storing upload", "oid", upload.OID, "error", err)
+		c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+		return
+	}
+
+	if l.config.UploadMode == UploadModeSync {
+		defer os.Remove(spoolPath)
+
+		if err := l.completeUpload(c, upload, spoolPath); err != nil {
+			l.promCollector.UploadFailures.With("destination", "upstream").Add(1)
+			slog.ErrorContext(ctx, "error uploading object to upstream", "oid", upload.OID, "error", err)
+			abortWithLFSError(c, http.StatusBadGateway, "error uploading object to upstream")
+			return
+		}
+	} else {
+		job := uploadJob{
+			Upload:    c.Param("id"),
+			SpoolPath: spoolPath,
+			Trace:     tracing.Carrier(ctx),
+		}
+
+		// The object is stored, so the client can go on while the upload to upstream is retried.
+		// Jobs are named after their spool so a client sending the object again doesn't leave a spool behind
+		if err := l.uploadQueue.Enqueue(ctx, filepath.Base(spoolPath), job); err != nil {
+			os.Remove(spoolPath)
+			slog.ErrorContext(ctx, "error queueing upload to upstream", "oid", upload.OID, "error", err)
+			c.AbortWithError(http.StatusServiceUnavailable, err) //nolint:errcheck
+			return
+		}
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// PostVerify answers the verify action of uploads received by the proxy. Objects are verified against the object store,
+// the verify action of upstream is called once the upload to upstream completes
+func (l LFSHandler) PostVerify(c *gin.Context) {
+	upload, ok := l.loadPendingUpload(c, "/uploads/"+c.Param("id")+"/verify")
+	if !ok {
+		return
+	}
+
+	var object BatchObjectResponse
+	if err := c.ShouldBindJSON(&object); err != nil {
+		abortWithLFSError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if object.OID != upload.OID || object.Size != upload.Size {
+		abortWithLFSError(c, http.StatusUnprocessableEntity, "object does not match the upload")
+		return
+	}
+
+	up := l.newUpstream(upload.UpstreamBaseURL, upload.Bucket, upload.KeyPrefix, "")
+
+	exists, err := up.objectStore.OIDExists(upload.OID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err) //nolint:errcheck
+		return
+	}
+
+	if !exists {
+		abortWithLFSError(c, http.StatusNotFound, "object not uploaded")
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// completeUpload sends a spooled object to the upload action of upstream, then calls its verify action if any
+func (l LFSHandler) completeUpload(ctx context.Context, upload *pendingUpload, spoolPath string) error {
+	body, err := os.Open(spoolPath)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", upload.Upload.Href, body)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = upload.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for key, value := range upload.Upload.Header {
+		req.Header.Set(key, value)
+	}
+
+	if err := l.sendUpstreamAction(req); err != nil {
+		return err
+	}
+
+	if upload.Verify == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(BatchObjectResponse{OID: upload.OID, Size: upload.Size})
+	if err != nil {
+		return err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "POST", upload.Verify.Href, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+	for key, value := range upload.Verify.Header {
+		req.Header.Set(key, value)
+	}
+
+	return l.sendUpstreamAction(req)
+}
+
+// sendUpstreamAction sends a request to an action href of upstream, failing unless it answers with 2xx
+func (l LFSHandler) sendUpstreamAction(req *http.Request) error {
+	resp, err := l.doUpstream(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBytes, _ := io.ReadAll(resp.Body)
+		return errors.New(resp.Status + ": " + string(respBytes))
+	}
+
+	return nil
+}
@@ -0,0 +1,449 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/config"
+	"github.com/vela-games/lfsproxy/services"
+)
+
+func startUploadQueue(t *testing.T, l *LFSHandler) {
+	var err error
+	l.uploadQueue, err = l.newUploadQueue()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go l.uploadQueue.Run(ctx)
+}
+
+func TestUploads(t *testing.T) {
+	// sha256 of "0123456789"
+	oid := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+	cfg := &config.Config{
+		UpstreamBaseURL:     "https://fake-git-server.com/repository.git/",
+		UploadEnabled:       true,
+		UploadMode:          UploadModeSync,
+		ProxyHrefExpiration: 1 * time.Hour,
+	}
+
+	signer := services.NewHrefSigner("http://localhost:9999", []byte("secret"), cfg.ProxyHrefExpiration)
+
+	fs, err := services.NewFSService(t.TempDir(), signer)
+	require.NoError(t, err)
+
+	cache := NewMockCache()
+	negativeCache := NewMockCache()
+
+	lfsHandler := LFSHandler{
+		cache:         cache,
+		negativeCache: negativeCache,
+		promCollector: testCollector,
+		config:        cfg,
+		objectStore:   fs,
+		signer:        signer,
+	}
+	startFillQueue(t, &lfsHandler)
+	startUploadQueue(t, &lfsHandler)
+
+	var mu sync.Mutex
+	var uploaded, verified []byte
+
+	// uploadExpiresIn is the expires_in of the upload action of upstream, if any
+	uploadExpiresIn := 0
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/objects/batch",
+		func(req *http.Request) (*http.Response, error) {
+			var batchRequest BatchRequest
+			if err := json.NewDecoder(req.Body).Decode(&batchRequest); err != nil {
+				return nil, err
+			}
+
+			// Upstream only gets objects once their upload completes
+			if batchRequest.Operation == "download" {
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"objects": []map[string]interface{}{
+						{
+							"oid":   oid,
+							"size":  10,
+							"error": map[string]interface{}{"code": 404, "message": "Object does not exist"},
+						},
+					},
+				})
+			}
+
+			return httpmock.NewJsonResponse(200, map[string]interface{}{
+				"transfer": "basic",
+				"objects": []map[string]interface{}{
+					{
+						"oid":  oid,
+						"size": 10,
+						"actions": map[string]interface{}{
+							"upload": map[string]interface{}{
+								"href":       "https://upstream-storage.com/" + oid,
+								"header":     map[string]interface{}{"Authorization": "Bearer upload-token"},
+								"expires_in": uploadExpiresIn,
+							},
+							"verify": map[string]interface{}{
+								"href":   "https://fake-git-server.com/repository.git/verify",
+								"header": map[string]interface{}{"Authorization": "Bearer verify-token"},
+							},
+						},
+					},
+					{
+						"oid":  testOID("already-on-upstream"),
+						"size": 10,
+					},
+				},
+			})
+		},
+	)
+
+	// uploadStarted is signalled when upstream starts receiving an upload, when set
+	var uploadStarted chan struct{}
+
+	httpmock.RegisterResponder("PUT", "https://upstream-storage.com/"+oid,
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Authorization") != "Bearer upload-token" {
+				return httpmock.NewStringResponse(401, ""), nil
+			}
+
+			mu.Lock()
+			started := uploadStarted
+			mu.Unlock()
+			if started != nil {
+				close(started)
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			body, _ := io.ReadAll(req.Body)
+			mu.Lock()
+			uploaded = body
+			mu.Unlock()
+			return httpmock.NewStringResponse(200, ""), nil
+		},
+	)
+
+	httpmock.RegisterResponder("POST", "https://fake-git-server.com/repository.git/verify",
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Authorization") != "Bearer verify-token" {
+				return httpmock.NewStringResponse(401, ""), nil
+			}
+
+			body, _ := io.ReadAll(req.Body)
+			mu.Lock()
+			verified = body
+			mu.Unlock()
+			return httpmock.NewStringResponse(200, ""), nil
+		},
+	)
+
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.POST("/objects/batch", lfsHandler.PostBatch)
+	r.PUT("/uploads/:id", lfsHandler.PutUpload)
+	r.POST("/uploads/:id/verify", lfsHandler.PostVerify)
+
+	do := func(method string, url string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	batch := func() BatchResponse {
+		w := do("POST", "http://localhost:9999/objects/batch", `{"operation":"upload","objects":[{"oid":"`+oid+`","size":10},{"oid":"`+testOID("already-on-upstream")+`","size":10}]}`)
+		require.Equal(t, 200, w.Code)
+
+		var batchResponse BatchResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batchResponse))
+		require.Len(t, batchResponse.Objects, 2)
+
+		return batchResponse
+	}
+
+	reset := func() {
+		cache.Reset()
+		negativeCache.Reset()
+		require.NoError(t, fs.Remove(testNamespace+oid))
+		mu.Lock()
+		uploaded, verified = nil, nil
+		mu.Unlock()
+	}
+
+	t.Run("it should point uploads to the proxy", func(t *testing.T) {
+		defer reset()
+
+		batchResponse := batch()
+
+		actions := batchResponse.Objects[0].Actions
+		assert.Contains(t, actions["upload"].Href, "http://localhost:9999/uploads/")
+		assert.Contains(t, actions["verify"].Href, "http://localhost:9999/uploads/")
+		assert.Empty(t, actions["upload"].Header)
+		assert.Equal(t, 3600, actions["upload"].ExpiresIn)
+
+		// Objects already on upstream are passed through untouched
+		assert.Equal(t, testOID("already-on-upstream"), batchResponse.Objects[1].OID)
+		assert.Empty(t, batchResponse.Objects[1].Actions)
+	})
+
+	t.Run("it should store uploads and complete them on upstream synchronously", func(t *testing.T) {
+		defer reset()
+
+		upstream := metricValue(t, "lfsproxy_upstream_duration_seconds")
+		responses := metricValue(t, "lfsproxy_upstream_response", "code", "200")
+
+		actions := batch().Objects[0].Actions
+
+		assert.Equal(t, 200, do("PUT", actions["upload"].Href, "0123456789").Code)
+
+		// The batch, the upload and its verify
+		assert.Equal(t, upstream+3, metricValue(t, "lfsproxy_upstream_duration_seconds"))
+		assert.Equal(t, responses+3, metricValue(t, "lfsproxy_upstream_response", "code", "200"))
+
+		exists, err := fs.OIDExists(testNamespace + oid)
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		mu.Lock()
+		assert.Equal(t, "0123456789", string(uploaded))
+		assert.JSONEq(t, `{"oid":"`+oid+`","size":10}`, string(verified))
+		mu.Unlock()
+
+		assert.Equal(t, 200, do("POST", actions["verify"].Href, `{"oid":"`+oid+`","size":10}`).Code)
+	})
+
+	t.Run("it should not hand out hrefs outliving the upstream upload", func(t *testing.T) {
+		defer reset()
+
+		uploadExpiresIn = 600
+		defer func() { uploadExpiresIn = 0 }()
+
+		actions := batch().Objects[0].Actions
+		for _, name := range []string{"upload", "verify"} {
+			assert.LessOrEqual(t, actions[name].ExpiresIn, 600)
+			assert.Greater(t, actions[name].ExpiresIn, 590)
+
+			u, err := url.Parse(actions[name].Href)
+			require.NoError(t, err)
+			expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, expires, time.Now().Add(600*time.Second).Unix())
+		}
+	})
+
+	t.Run("it should serve uploads upstream doesn't have yet", func(t *testing.T) {
+		defer reset()
+
+		actions := batch().Objects[0].Actions
+		assert.Equal(t, 200, do("PUT", actions["upload"].Href, "0123456789").Code)
+
+		w := do("POST", "http://localhost:9999/objects/batch", `{"operation":"download","objects":[{"oid":"`+oid+`","size":10}]}`)
+		require.Equal(t, 200, w.Code)
+
+		var batchResponse BatchResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batchResponse))
+		require.Len(t, batchResponse.Objects, 1)
+		assert.Nil(t, batchResponse.Objects[0].Error)
+		assert.Contains(t, batchResponse.Objects[0].Actions["download"].Href, "http://localhost:9999/objects/")
+		assert.False(t, negativeCache.Has(testNamespace+oid))
+	})
+
+	t.Run("it should carry uploads in their hrefs rather than the cache", func(t *testing.T) {
+		defer reset()
+
+		actions := batch().Objects[0].Actions
+		assert.NotContains(t, actions["upload"].Href, "upload-token")
+
+		// As if the object was sent to another replica
+		cache.Reset()
+
+		assert.Equal(t, 200, do("PUT", actions["upload"].Href, "0123456789").Code)
+		assert.Equal(t, 200, do("POST", actions["verify"].Href, `{"oid":"`+oid+`","size":10}`).Code)
+	})
+
+	t.Run("it should complete uploads on upstream asynchronously", func(t *testing.T) {
+		defer reset()
+
+		cfg.UploadMode = UploadModeAsync
+		defer func() { cfg.UploadMode = UploadModeSync }()
+
+		actions := batch().Objects[0].Actions
+
+		assert.Equal(t, 200, do("PUT", actions["upload"].Href, "0123456789").Code)
+		assert.Equal(t, 200, do("POST", actions["verify"].Href, `{"oid":"`+oid+`","size":10}`).Code)
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return string(uploaded) == "0123456789" && verified != nil
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should reject uploads of the wrong size", func(t *testing.T) {
+		defer reset()
+
+		actions := batch().Objects[0].Actions
+
+		w := do("PUT", actions["upload"].Href, "012345")
+		assert.Equal(t, 422, w.Code)
+		assert.Equal(t, 404, do("POST", actions["verify"].Href, `{"oid":"`+oid+`","size":10}`).Code)
+
+		mu.Lock()
+		assert.Nil(t, uploaded)
+		mu.Unlock()
+	})
+
+	t.Run("it should reject corrupted uploads", func(t *testing.T) {
+		defer reset()
+
+		actions := batch().Objects[0].Actions
+
+		assert.Equal(t, 422, do("PUT", actions["upload"].Href, "0123456780").Code)
+
+		exists, err := fs.OIDExists(testNamespace + oid)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("it should reject verify requests of other objects", func(t *testing.T) {
+		defer reset()
+
+		actions := batch().Objects[0].Actions
+
+		assert.Equal(t, 200, do("PUT", actions["upload"].Href, "0123456789").Code)
+		assert.Equal(t, 422, do("POST", actions["verify"].Href, `{"oid":"`+testOID("another-oid")+`","size":10}`).Code)
+	})
+
+	t.Run("it should reject unsigned uploads", func(t *testing.T) {
+		defer reset()
+
+		batch()
+
+		assert.Equal(t, 403, do("PUT", "http://localhost:9999/uploads/some-id", "0123456789").Code)
+
+		// Signed hrefs to state sealed with another key
+		other := services.NewHrefSigner("http://localhost:9999", []byte("other"), cfg.ProxyHrefExpiration)
+		token, err := other.Seal([]byte(`{"oid":"` + oid + `","size":10}`))
+		require.NoError(t, err)
+		assert.Equal(t, 403, do("PUT", signer.Sign("/uploads/"+token), "0123456789").Code)
+	})
+
+	t.Run("it should pass uploads through when disabled", func(t *testing.T) {
+		defer reset()
+
+		cfg.UploadEnabled = false
+		defer func() { cfg.UploadEnabled = true }()
+
+		actions := batch().Objects[0].Actions
+		assert.Equal(t, "https://upstream-storage.com/"+oid, actions["upload"].Href)
+		assert.Equal(t, "Bearer upload-token", actions["upload"].Header["Authorization"])
+	})
+
+	t.Run("it should resume background uploads left queued by a previous run", func(t *testing.T) {
+		defer reset()
+
+		queueCfg := *cfg
+		queueCfg.UploadMode = UploadModeAsync
+		queueCfg.UploadQueueDir = t.TempDir()
+
+		// Never run, as if the process stopped before getting to the upload
+		stoppedHandler := lfsHandler
+		stoppedHandler.config = &queueCfg
+		stoppedHandler.uploadQueue, err = stoppedHandler.newUploadQueue()
+		require.NoError(t, err)
+
+		_, stopped := gin.CreateTestContext(httptest.NewRecorder())
+		stopped.PUT("/uploads/:id", stoppedHandler.PutUpload)
+
+		actions := batch().Objects[0].Actions
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", actions["upload"].Href, bytes.NewBufferString("0123456789"))
+		stopped.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+
+		spooled, err := os.ReadDir(filepath.Join(queueCfg.UploadQueueDir, "spool"))
+		require.NoError(t, err)
+		assert.Len(t, spooled, 1)
+
+		// The credentials of the upstream actions aren't kept on disk in the clear
+		err = filepath.WalkDir(queueCfg.UploadQueueDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			data, err := os.ReadFile(path)
+			assert.NotContains(t, string(data), "upload-token")
+			return err
+		})
+		require.NoError(t, err)
+
+		resumedHandler := stoppedHandler
+		startUploadQueue(t, &resumedHandler)
+		assert.Equal(t, 1, resumedHandler.uploadQueue.Len())
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return string(uploaded) == "0123456789" && verified != nil
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.Eventually(t, func() bool {
+			spooled, _ := os.ReadDir(filepath.Join(queueCfg.UploadQueueDir, "spool"))
+			return len(spooled) == 0
+		}, 1*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should wait for background uploads to complete on drain", func(t *testing.T) {
+		defer reset()
+
+		cfg.UploadMode = UploadModeAsync
+		defer func() { cfg.UploadMode = UploadModeSync }()
+
+		started := make(chan struct{})
+		mu.Lock()
+		uploadStarted = started
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			uploadStarted = nil
+			mu.Unlock()
+		}()
+
+		actions := batch().Objects[0].Actions
+
+		assert.Equal(t, 200, do("PUT", actions["upload"].Href, "0123456789").Code)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, lfsHandler.Drain(ctx))
+
+		mu.Lock()
+		assert.Equal(t, "0123456789", string(uploaded))
+		assert.NotNil(t, verified)
+		mu.Unlock()
+	})
+}
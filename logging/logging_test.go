@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var decoded map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &decoded))
+		lines = append(lines, decoded)
+	}
+
+	return lines
+}
+
+func TestLogger(t *testing.T) {
+	t.Run("it should add the attributes of the context to every line", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := NewLogger(&buf, false)
+
+		ctx := WithRequestID(context.Background(), "some-id")
+		ctx = With(ctx, slog.String("operation", "download"))
+		logger.InfoContext(ctx, "some message", "oid", "some-oid")
+
+		lines := decodeLines(t, &buf)
+		require.Len(t, lines, 1)
+		assert.Equal(t, "some message", lines[0]["msg"])
+		assert.Equal(t, "some-id", lines[0]["request_id"])
+		assert.Equal(t, "download", lines[0]["operation"])
+		assert.Equal(t, "some-oid", lines[0]["oid"])
+	})
+
+	t.Run("it should keep the attributes on contexts outliving the request", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(WithRequestID(context.Background(), "some-id"))
+		cancel()
+
+		assert.Equal(t, "some-id", RequestID(context.WithoutCancel(ctx)))
+	})
+
+	t.Run("it should only log debug lines in debug mode", func(t *testing.T) {
+		var buf bytes.Buffer
+		NewLogger(&buf, false).Debug("some message")
+		assert.Empty(t, buf.String())
+
+		NewLogger(&buf, true).Debug("some message")
+		assert.NotEmpty(t, buf.String())
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(NewLogger(&buf, false))
+
+	var requestID string
+	_, r := gin.CreateTestContext(httptest.NewRecorder())
+	r.Use(Middleware())
+	r.GET("/some-path", func(c *gin.Context) {
+		requestID = RequestID(c.Request.Context())
+		c.Status(http.StatusNoContent)
+	})
+
+	do := func(id string) *httptest.ResponseRecorder {
+		buf.Reset()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/some-path", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("it should reuse the request ID of the client", func(t *testing.T) {
+		w := do("some-id")
+		assert.Equal(t, "some-id", w.Header().Get(RequestIDHeader))
+		assert.Equal(t, "some-id", requestID)
+
+		lines := decodeLines(t, &buf)
+		require.Len(t, lines, 1)
+		assert.Equal(t, "request served", lines[0]["msg"])
+		assert.Equal(t, "some-id", lines[0]["request_id"])
+		assert.Equal(t, "/some-path", lines[0]["path"])
+		assert.Equal(t, float64(http.StatusNoContent), lines[0]["status"])
+	})
+
+	for _, id := range []string{"", "some id", strings.Repeat("a", 129)} {
+		t.Run("it should generate a request ID when the client sends "+id, func(t *testing.T) {
+			w := do(id)
+			assert.Regexp(t, `^[0-9a-f]{32}$`, w.Header().Get(RequestIDHeader))
+			assert.Equal(t, w.Header().Get(RequestIDHeader), requestID)
+		})
+	}
+}
@@ -0,0 +1,545 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/vela-games/lfsproxy/logging"
+)
+
+// Job is a unit of background work. Jobs are kept as JSON files on disk until they complete
+type Job struct {
+	ID          string          `json:"id"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	// Deferrals counts the retries that didn't count as attempts, see Defer
+	Deferrals int `json:"deferrals,omitempty"`
+	// RequestID is the request the job was queued by, carried by the log lines of the job
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// logContext carries the request ID of the job, if any, to the log lines of the queue
+func (j *Job) logContext() context.Context {
+	return logging.WithRequestID(context.Background(), j.RequestID)
+}
+
+// Handler runs a job. Jobs are retried when it returns an error, unless the error is wrapped with Permanent
+type Handler func(ctx context.Context, job *Job) error
+
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+func (p permanentError) Unwrap() error {
+	return p.err
+}
+
+// Permanent marks an error as not worth retrying, the job is dead-lettered right away
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+type deferredError struct {
+	err error
+}
+
+func (d deferredError) Error() string {
+	return d.err.Error()
+}
+
+func (d deferredError) Unwrap() error {
+	return d.err
+}
+
+// Defer marks an error as not a failure of the job, such as when another process holds what it needs.
+// The job is retried with backoff without counting as an attempt
+func Defer(err error) error {
+	return deferredError{err: err}
+}
+
+// Metrics are the metrics a Queue reports, unset metrics are discarded
+type Metrics struct {
+	Enqueued     metrics.Counter
+	Completed    metrics.Counter
+	Retried      metrics.Counter
+	DeadLettered metrics.Counter
+	Depth        metrics.Gauge
+}
+
+type Options struct {
+	// Dir keeps pending jobs on pending/ and dead-lettered jobs on dead/, jobs are only kept in memory when empty
+	Dir            string
+	Workers        int
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// DeadRetention is how long dead-lettered jobs are kept on Dir, they are kept until removed by hand when zero
+	DeadRetention time.Duration
+	// OnDeadLetter is called once a job is dead-lettered, to release what the job holds besides its payload
+	OnDeadLetter func(job *Job)
+	Metrics      Metrics
+}
+
+// Queue runs jobs on a bounded number of workers, retrying failed jobs with exponential backoff.
+// Jobs failing MaxAttempts times are dead-lettered
+type Queue struct {
+	opts    Options
+	handler Handler
+
+	mu         sync.Mutex
+	pending    map[string]*Job
+	processing map[string]struct{}
+	wake       chan struct{}
+
+	closed  bool
+	stop    chan struct{}
+	running bool
+	done    chan struct{}
+	abort   context.CancelFunc
+}
+
+var ErrClosed = errors.New("queue closed")
+
+func New(opts Options, handler Handler) (*Queue, error) {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+
+	for _, m := range []*metrics.Counter{&opts.Metrics.Enqueued, &opts.Metrics.Completed, &opts.Metrics.Retried, &opts.Metrics.DeadLettered} {
+		if *m == nil {
+			*m = discard.NewCounter()
+		}
+	}
+	if opts.Metrics.Depth == nil {
+		opts.Metrics.Depth = discard.NewGauge()
+	}
+
+	q := &Queue{
+		opts:       opts,
+		handler:    handler,
+		pending:    map[string]*Job{},
+		processing: map[string]struct{}{},
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if opts.Dir != "" {
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// load picks up the jobs left pending by a previous run
+func (q *Queue) load() error {
+	// Payloads may hold credentials
+	for _, dir := range []string{q.pendingDir(), q.deadDir()} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+
+	q.pruneDead()
+
+	entries, err := os.ReadDir(q.pendingDir())
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// Jobs that were being written when the previous run stopped
+		if strings.HasPrefix(entry.Name(), ".job-") {
+			os.Remove(filepath.Join(q.pendingDir(), entry.Name()))
+			continue
+		}
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(q.pendingDir(), entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			slog.Error("error loading queued job", "file", entry.Name(), "error", err)
+			continue
+		}
+
+		q.pending[job.ID] = &job
+	}
+
+	q.opts.Metrics.Depth.Set(float64(len(q.pending)))
+
+	return nil
+}
+
+// Enqueue adds a job queued by the request of ctx, jobs with the ID of a job already queued or running are ignored
+func (q *Queue) Enqueue(ctx context.Context, id string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	if _, ok := q.pending[id]; ok {
+		return nil
+	}
+	if _, ok := q.processing[id]; ok {
+		return nil
+	}
+
+	job := &Job{
+		ID:          id,
+		Payload:     data,
+		NextAttempt: time.Now(),
+		RequestID:   logging.RequestID(ctx),
+	}
+
+	if err := q.persist(q.pendingDir(), job); err != nil {
+		return err
+	}
+
+	q.pending[id] = job
+	q.opts.Metrics.Enqueued.Add(1)
+	q.opts.Metrics.Depth.Set(float64(len(q.pending) + len(q.processing)))
+	q.notify()
+
+	return nil
+}
+
+// Run runs jobs until the queue is drained or ctx is done, cancelling ctx aborts the running jobs.
+// A Queue can only run once
+func (q *Queue) Run(ctx context.Context) {
+	defer close(q.done)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q.mu.Lock()
+	q.running = true
+	q.abort = cancel
+	q.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < q.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Close stops accepting jobs and lets workers stop once they are done with their current job
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+	}
+}
+
+// Drain closes the queue and waits for the running jobs to complete. Jobs still running when ctx is done are aborted.
+// Jobs that didn't run are left pending on disk for the next run
+func (q *Queue) Drain(ctx context.Context) error {
+	q.Close()
+
+	q.mu.Lock()
+	running, abort := q.running, q.abort
+	q.mu.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	var err error
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		abort()
+		<-q.done
+	}
+
+	if left := q.Len(); left > 0 {
+		slog.Info("jobs left queued", "jobs", left)
+	}
+
+	return err
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		job, wait := q.next()
+		if job == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-q.stop:
+				timer.Stop()
+				return
+			case <-q.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+
+		q.run(ctx, job)
+	}
+}
+
+// next takes the oldest job due, or tells how long to wait for one
+func (q *Queue) next() (*Job, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due *Job
+	wait := time.Minute
+	now := time.Now()
+
+	for _, job := range q.pending {
+		if until := job.NextAttempt.Sub(now); until > 0 {
+			if until < wait {
+				wait = until
+			}
+			continue
+		}
+
+		if due == nil || job.NextAttempt.Before(due.NextAttempt) {
+			due = job
+		}
+	}
+
+	if due != nil {
+		delete(q.pending, due.ID)
+		q.processing[due.ID] = struct{}{}
+
+		// Wake another worker for the jobs left
+		if len(q.pending) > 0 {
+			q.notify()
+		}
+	}
+
+	return due, wait
+}
+
+func (q *Queue) run(ctx context.Context, job *Job) {
+	err := q.handler(ctx, job)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer func() {
+		q.opts.Metrics.Depth.Set(float64(len(q.pending) + len(q.processing)))
+	}()
+
+	delete(q.processing, job.ID)
+
+	if err == nil {
+		q.opts.Metrics.Completed.Add(1)
+		q.remove(q.pendingDir(), job)
+		return
+	}
+
+	// Aborted by Drain, it doesn't count as an attempt
+	if ctx.Err() != nil {
+		q.pending[job.ID] = job
+		return
+	}
+
+	job.LastError = err.Error()
+
+	var deferred deferredError
+	if errors.As(err, &deferred) {
+		job.Deferrals++
+		job.NextAttempt = time.Now().Add(q.backoff(job.Deferrals))
+		slog.DebugContext(job.logContext(), "deferring job", "job", job.ID, "deferrals", job.Deferrals, "next_attempt", job.NextAttempt, "error", err)
+		q.requeue(job)
+		return
+	}
+
+	job.Attempts++
+
+	var permanent permanentError
+	if errors.As(err, &permanent) || job.Attempts >= q.opts.MaxAttempts {
+		slog.ErrorContext(job.logContext(), "dead-lettering job", "job", job.ID, "attempts", job.Attempts, "error", err)
+		q.opts.Metrics.DeadLettered.Add(1)
+
+		if err := q.persist(q.deadDir(), job); err != nil {
+			slog.Error("error dead-lettering job", "job", job.ID, "error", err)
+		}
+		q.remove(q.pendingDir(), job)
+		q.pruneDead()
+
+		if q.opts.OnDeadLetter != nil {
+			q.opts.OnDeadLetter(job)
+		}
+		return
+	}
+
+	job.NextAttempt = time.Now().Add(q.backoff(job.Attempts))
+	slog.WarnContext(job.logContext(), "retrying job", "job", job.ID, "attempts", job.Attempts, "next_attempt", job.NextAttempt, "error", err)
+	q.opts.Metrics.Retried.Add(1)
+	q.requeue(job)
+}
+
+// requeue puts a job back to wait for its next attempt
+func (q *Queue) requeue(job *Job) {
+	if err := q.persist(q.pendingDir(), job); err != nil {
+		slog.Error("error persisting job", "job", job.ID, "error", err)
+	}
+
+	q.pending[job.ID] = job
+	q.notify()
+}
+
+// backoff doubles the wait after every failed attempt, up to MaxBackoff
+func (q *Queue) backoff(attempts int) time.Duration {
+	backoff := q.opts.InitialBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if q.opts.MaxBackoff > 0 && backoff >= q.opts.MaxBackoff {
+			return q.opts.MaxBackoff
+		}
+	}
+
+	return backoff
+}
+
+// Len returns how many jobs are queued or running
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending) + len(q.processing)
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) pendingDir() string {
+	return filepath.Join(q.opts.Dir, "pending")
+}
+
+func (q *Queue) deadDir() string {
+	return filepath.Join(q.opts.Dir, "dead")
+}
+
+// jobFile names job files after their ID, which may contain any character
+func jobFile(dir string, job *Job) string {
+	return filepath.Join(dir, fmt.Sprintf("%x.json", job.ID))
+}
+
+// persist writes a job to dir through a temporary file so a crash never leaves a partial job behind
+func (q *Queue) persist(dir string, job *Job) error {
+	if q.opts.Dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".job-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), jobFile(dir, job))
+}
+
+// pruneDead removes the jobs dead-lettered longer than DeadRetention ago
+func (q *Queue) pruneDead() {
+	if q.opts.Dir == "" || q.opts.DeadRetention <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(q.deadDir())
+	if err != nil {
+		slog.Error("error listing dead-lettered jobs", "error", err)
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < q.opts.DeadRetention {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(q.deadDir(), entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("error removing dead-lettered job", "file", entry.Name(), "error", err)
+		}
+	}
+}
+
+func (q *Queue) remove(dir string, job *Job) {
+	if q.opts.Dir == "" {
+		return
+	}
+
+	if err := os.Remove(jobFile(dir, job)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("error removing job", "job", job.ID, "error", err)
+	}
+}
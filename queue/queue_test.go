@@ -0,0 +1,346 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vela-games/lfsproxy/logging"
+)
+
+func run(t *testing.T, q *Queue) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestQueue(t *testing.T) {
+	t.Run("it should run enqueued jobs", func(t *testing.T) {
+		var mu sync.Mutex
+		var payloads []string
+
+		completed := generic.NewCounter("completed")
+
+		q, err := New(Options{Workers: 2, Metrics: Metrics{Completed: completed}}, func(ctx context.Context, job *Job) error {
+			mu.Lock()
+			defer mu.Unlock()
+			payloads = append(payloads, string(job.Payload))
+			return nil
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		require.NoError(t, q.Enqueue(context.Background(), "a", "first"))
+		require.NoError(t, q.Enqueue(context.Background(), "b", "second"))
+
+		assert.Eventually(t, func() bool { return q.Len() == 0 && completed.Value() == 2 }, 1*time.Second, 10*time.Millisecond)
+		assert.ElementsMatch(t, []string{`"first"`, `"second"`}, payloads)
+	})
+
+	t.Run("it should ignore jobs already queued", func(t *testing.T) {
+		release := make(chan struct{})
+		var runs atomic.Int32
+
+		q, err := New(Options{Workers: 4}, func(ctx context.Context, job *Job) error {
+			runs.Add(1)
+			<-release
+			return nil
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		for i := 0; i < 10; i++ {
+			require.NoError(t, q.Enqueue(context.Background(), "same", "payload"))
+		}
+
+		assert.Eventually(t, func() bool { return runs.Load() == 1 }, 1*time.Second, 10*time.Millisecond)
+		require.NoError(t, q.Enqueue(context.Background(), "same", "payload"))
+		close(release)
+
+		assert.Eventually(t, func() bool { return q.Len() == 0 }, 1*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int32(1), runs.Load())
+	})
+
+	t.Run("it should retry failed jobs with backoff", func(t *testing.T) {
+		var attempts []time.Time
+		retried := generic.NewCounter("retried")
+
+		q, err := New(Options{
+			MaxAttempts:    5,
+			InitialBackoff: 20 * time.Millisecond,
+			Metrics:        Metrics{Retried: retried},
+		}, func(ctx context.Context, job *Job) error {
+			attempts = append(attempts, time.Now())
+			if len(attempts) < 3 {
+				return errors.New("transient failure")
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		require.NoError(t, q.Enqueue(context.Background(), "flaky", "payload"))
+
+		assert.Eventually(t, func() bool { return q.Len() == 0 }, 2*time.Second, 10*time.Millisecond)
+		require.Len(t, attempts, 3)
+		assert.Equal(t, float64(2), retried.Value())
+		assert.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), 20*time.Millisecond)
+		assert.GreaterOrEqual(t, attempts[2].Sub(attempts[1]), 40*time.Millisecond)
+	})
+
+	t.Run("it should dead-letter jobs failing too many times", func(t *testing.T) {
+		dir := t.TempDir()
+		deadLettered := generic.NewCounter("dead")
+
+		q, err := New(Options{Dir: dir, MaxAttempts: 2, InitialBackoff: 1 * time.Millisecond, Metrics: Metrics{DeadLettered: deadLettered}}, func(ctx context.Context, job *Job) error {
+			return errors.New("broken")
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		require.NoError(t, q.Enqueue(context.Background(), "broken", "payload"))
+
+		assert.Eventually(t, func() bool { return deadLettered.Value() == 1 }, 1*time.Second, 10*time.Millisecond)
+
+		pending, _ := os.ReadDir(filepath.Join(dir, "pending"))
+		dead, _ := os.ReadDir(filepath.Join(dir, "dead"))
+		assert.Empty(t, pending)
+		assert.Len(t, dead, 1)
+	})
+
+	t.Run("it should not count deferred jobs as failed attempts", func(t *testing.T) {
+		var runs []Job
+		q, err := New(Options{MaxAttempts: 2, InitialBackoff: 1 * time.Millisecond}, func(ctx context.Context, job *Job) error {
+			runs = append(runs, *job)
+			if len(runs) < 4 {
+				return Defer(errors.New("held elsewhere"))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		require.NoError(t, q.Enqueue(context.Background(), "deferred", "payload"))
+
+		assert.Eventually(t, func() bool { return q.Len() == 0 }, 2*time.Second, 10*time.Millisecond)
+		require.Len(t, runs, 4)
+		assert.Equal(t, 0, runs[3].Attempts)
+		assert.Equal(t, 3, runs[3].Deferrals)
+	})
+
+	t.Run("it should remove jobs dead-lettered longer than the retention ago", func(t *testing.T) {
+		dir := t.TempDir()
+
+		q, err := New(Options{Dir: dir, DeadRetention: 1 * time.Hour}, func(ctx context.Context, job *Job) error {
+			return Permanent(errors.New("gone"))
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		dead := func() []string {
+			var names []string
+			entries, _ := os.ReadDir(filepath.Join(dir, "dead"))
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			return names
+		}
+
+		require.NoError(t, q.Enqueue(context.Background(), "old", "payload"))
+		require.Eventually(t, func() bool { return len(dead()) == 1 }, 1*time.Second, 10*time.Millisecond)
+
+		old := dead()[0]
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "dead", old), time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+
+		require.NoError(t, q.Enqueue(context.Background(), "recent", "payload"))
+		assert.Eventually(t, func() bool {
+			names := dead()
+			return len(names) == 1 && names[0] != old
+		}, 1*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("it should not retry permanent failures", func(t *testing.T) {
+		var runs atomic.Int32
+		deadLettered := generic.NewCounter("dead")
+
+		q, err := New(Options{MaxAttempts: 5, Metrics: Metrics{DeadLettered: deadLettered}}, func(ctx context.Context, job *Job) error {
+			runs.Add(1)
+			return Permanent(errors.New("gone"))
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		require.NoError(t, q.Enqueue(context.Background(), "gone", "payload"))
+
+		assert.Eventually(t, func() bool { return deadLettered.Value() == 1 }, 1*time.Second, 10*time.Millisecond)
+		assert.Equal(t, int32(1), runs.Load())
+	})
+
+	t.Run("it should hand dead-lettered jobs over", func(t *testing.T) {
+		deadLetters := make(chan string, 1)
+
+		q, err := New(Options{OnDeadLetter: func(job *Job) { deadLetters <- job.ID }}, func(ctx context.Context, job *Job) error {
+			return Permanent(errors.New("gone"))
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		require.NoError(t, q.Enqueue(context.Background(), "gone", "payload"))
+
+		select {
+		case id := <-deadLetters:
+			assert.Equal(t, "gone", id)
+		case <-time.After(1 * time.Second):
+			assert.Fail(t, "job not dead-lettered")
+		}
+	})
+
+	t.Run("it should log retries and dead letters with the request ID of the job", func(t *testing.T) {
+		var buf bytes.Buffer
+		defer slog.SetDefault(slog.Default())
+		slog.SetDefault(logging.NewLogger(&buf, false))
+
+		deadLetters := make(chan string, 1)
+
+		q, err := New(Options{MaxAttempts: 2, InitialBackoff: 1 * time.Millisecond, OnDeadLetter: func(job *Job) { deadLetters <- job.ID }}, func(ctx context.Context, job *Job) error {
+			return errors.New("broken")
+		})
+		require.NoError(t, err)
+		run(t, q)
+
+		require.NoError(t, q.Enqueue(logging.WithRequestID(context.Background(), "some-id"), "broken", "payload"))
+
+		select {
+		case <-deadLetters:
+		case <-time.After(1 * time.Second):
+			require.Fail(t, "job not dead-lettered")
+		}
+
+		var messages []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var decoded map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(line), &decoded))
+			assert.Equal(t, "some-id", decoded["request_id"])
+			messages = append(messages, decoded["msg"].(string))
+		}
+		assert.Equal(t, []string{"retrying job", "dead-lettering job"}, messages)
+	})
+
+	t.Run("it should resume jobs left pending on disk", func(t *testing.T) {
+		dir := t.TempDir()
+
+		// Never run, as if the process stopped before getting to it
+		q, err := New(Options{Dir: dir}, func(ctx context.Context, job *Job) error {
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, q.Enqueue(context.Background(), "left-behind", "payload"))
+
+		var resumed atomic.Value
+		q, err = New(Options{Dir: dir}, func(ctx context.Context, job *Job) error {
+			resumed.Store(job.ID)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 1, q.Len())
+		run(t, q)
+
+		assert.Eventually(t, func() bool { return resumed.Load() == "left-behind" && q.Len() == 0 }, 1*time.Second, 10*time.Millisecond)
+
+		pending, _ := os.ReadDir(filepath.Join(dir, "pending"))
+		assert.Empty(t, pending)
+	})
+}
+
+func TestQueueDrain(t *testing.T) {
+	t.Run("it should wait for running jobs and keep the others on disk", func(t *testing.T) {
+		dir := t.TempDir()
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		q, err := New(Options{Dir: dir, Workers: 1}, func(ctx context.Context, job *Job) error {
+			close(started)
+			<-release
+			return nil
+		})
+		require.NoError(t, err)
+		go q.Run(context.Background())
+
+		require.NoError(t, q.Enqueue(context.Background(), "running", "payload"))
+		<-started
+		require.NoError(t, q.Enqueue(context.Background(), "waiting", "payload"))
+
+		drained := make(chan error)
+		go func() {
+			drained <- q.Drain(context.Background())
+		}()
+
+		assert.Eventually(t, func() bool {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return q.closed
+		}, 1*time.Second, 10*time.Millisecond)
+		assert.ErrorIs(t, q.Enqueue(context.Background(), "late", "payload"), ErrClosed)
+
+		close(release)
+		assert.NoError(t, <-drained)
+
+		q, err = New(Options{Dir: dir}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, q.Len())
+		assert.Contains(t, q.pending, "waiting")
+	})
+
+	t.Run("it should abort jobs still running after the drain period", func(t *testing.T) {
+		dir := t.TempDir()
+		started := make(chan struct{})
+
+		q, err := New(Options{Dir: dir, MaxAttempts: 1}, func(ctx context.Context, job *Job) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		require.NoError(t, err)
+		go q.Run(context.Background())
+
+		require.NoError(t, q.Enqueue(context.Background(), "slow", "payload"))
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, q.Drain(ctx), context.DeadlineExceeded)
+
+		// Not dead-lettered, it resumes on the next run
+		q, err = New(Options{Dir: dir}, nil)
+		require.NoError(t, err)
+		require.Contains(t, q.pending, "slow")
+		assert.Equal(t, 0, q.pending["slow"].Attempts)
+	})
+
+	t.Run("it should drain queues that never ran", func(t *testing.T) {
+		q, err := New(Options{}, nil)
+		require.NoError(t, err)
+		assert.NoError(t, q.Drain(context.Background()))
+	})
+}
@@ -2,8 +2,10 @@ package router
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -13,38 +15,76 @@ import (
 	"github.com/vela-games/lfsproxy/config"
 	"github.com/vela-games/lfsproxy/exporter"
 	"github.com/vela-games/lfsproxy/handlers"
+	"github.com/vela-games/lfsproxy/logging"
+	"github.com/vela-games/lfsproxy/tracing"
 )
 
 type Router struct {
-	engine *gin.Engine
+	engine         *gin.Engine
+	healthHandler  handlers.HealthHandler
+	lfsHandler     *handlers.LFSHandler
+	readinessDelay time.Duration
+	drainPeriod    time.Duration
 }
 
-func NewRouter() Router {
+func NewRouter() *Router {
 	if viper.GetBool("debug_mode") {
 		gin.SetMode(gin.DebugMode)
 	} else {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	gin := gin.Default()
-	gin.Use(cors.Default())
+	engine := gin.New()
+	engine.Use(tracing.Middleware(), logging.Middleware(), gin.Recovery(), cors.Default())
 
-	return Router{
-		engine: gin,
+	return &Router{
+		engine:        engine,
+		healthHandler: handlers.NewHealthHandler(),
 	}
 }
 
-func (r Router) InitRoutes(ctx context.Context, cfg *config.Config) error {
-	healthHandler := handlers.HealthHandler{}
+func (r *Router) InitRoutes(ctx context.Context, cfg *config.Config) error {
+	healthHandler := r.healthHandler
 
 	lfsHandler, err := handlers.NewLFSHandler(ctx, cfg)
 	if err != nil {
 		return err
 	}
+	r.lfsHandler = lfsHandler
+	r.readinessDelay = cfg.ShutdownReadinessDelay
+	r.drainPeriod = cfg.ShutdownDrainPeriod
+
+	// Objects are registered before the gzip middleware so Range requests
+	// and Content-Length are served untouched
+	r.engine.GET("/objects/*key", lfsHandler.GetObject)
+	r.engine.HEAD("/objects/*key", lfsHandler.GetObject)
+
+	if cfg.TeeStreamingEnabled {
+		r.engine.GET("/tee/:id", lfsHandler.GetTee)
+		r.engine.HEAD("/tee/:id", lfsHandler.GetTee)
+	}
+
+	if cfg.UploadEnabled {
+		r.engine.PUT("/uploads/:id", lfsHandler.PutUpload)
+		r.engine.POST("/uploads/:id/verify", lfsHandler.PostVerify)
+	}
 
 	r.engine.Use(gzip.Gzip(gzip.DefaultCompression))
 	r.engine.GET("/health", healthHandler.Get)
+	r.engine.GET("/ready", healthHandler.Ready)
 	r.engine.POST("/objects/batch", lfsHandler.PostBatch)
+	r.engine.GET("/locks", lfsHandler.ProxyLocks)
+	r.engine.POST("/locks", lfsHandler.ProxyLocks)
+	r.engine.POST("/locks/verify", lfsHandler.ProxyLocks)
+	r.engine.POST("/locks/:id/unlock", lfsHandler.ProxyLocks)
+
+	if cfg.RoutesFile != "" {
+		r.engine.POST("/:owner/:repo/info/lfs/objects/batch", lfsHandler.PostBatch)
+		r.engine.GET("/:owner/:repo/info/lfs/locks", lfsHandler.ProxyLocks)
+		r.engine.POST("/:owner/:repo/info/lfs/locks", lfsHandler.ProxyLocks)
+		r.engine.POST("/:owner/:repo/info/lfs/locks/verify", lfsHandler.ProxyLocks)
+		r.engine.POST("/:owner/:repo/info/lfs/locks/:id/unlock", lfsHandler.ProxyLocks)
+	}
 
 	if cfg.EnablePrometheusExporter {
 		r.engine.GET("/metrics", exporter.PrometheusHandler())
@@ -53,7 +93,7 @@ func (r Router) InitRoutes(ctx context.Context, cfg *config.Config) error {
 	return nil
 }
 
-func (r Router) Run(ctx context.Context, portBinding string) error {
+func (r *Router) Run(ctx context.Context, portBinding string) error {
 	srv := &http.Server{
 		Addr:              portBinding,
 		Handler:           r.engine,
@@ -63,19 +103,29 @@ func (r Router) Run(ctx context.Context, portBinding string) error {
 
 	go r.listen(srv)
 	<-ctx.Done()
-	log.Println("shutting down server")
+	slog.Info("shutting down server", "readiness_delay", r.readinessDelay.String(), "drain_period", r.drainPeriod.String())
+
+	// Requests, cache fills and uploads to upstream share the drain period,
+	// fills that don't complete within it stay queued for the next run
+	r.healthHandler.Drain()
 
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Keep serving new requests until load balancers have seen the readiness probe fail
+	time.Sleep(r.readinessDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), r.drainPeriod)
 	defer cancel()
-	if err := srv.Shutdown(timeoutCtx); err != nil {
-		return err
+	err := srv.Shutdown(drainCtx)
+
+	if r.lfsHandler != nil {
+		err = errors.Join(err, r.lfsHandler.Drain(drainCtx))
 	}
 
-	return nil
+	return err
 }
 
-func (r Router) listen(srv *http.Server) {
+func (r *Router) listen(srv *http.Server) {
 	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("error trying to listen: %s\n", err)
+		slog.Error("error trying to listen", "error", err)
+		os.Exit(1)
 	}
 }
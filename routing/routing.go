@@ -0,0 +1,202 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrNoRoute           = errors.New("no route matches repository")
+	ErrInvalidRepository = errors.New("invalid repository")
+
+	repositorySegment = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// Route maps repositories to an upstream LFS server.
+//
+// A route matches either one Repository exactly ("owner/repo.git") or every repository under Prefix,
+// which matches whole path segments: "org/game" matches "org/game" but not "org/game-private.git".
+// Upstream may be templated with {owner} and {repo} (the repository name without .git), including its host
+type Route struct {
+	Repository string `yaml:"repository"`
+	Prefix     string `yaml:"prefix"`
+	Upstream   string `yaml:"upstream"`
+	// Bucket overrides the bucket (or container) of the storage backend for this route
+	Bucket string `yaml:"bucket"`
+	// KeyPrefix is prepended to the storage keys of this route
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// Resolved is a route resolved for a given repository
+type Resolved struct {
+	*Route
+	// Repository is the "owner/repo.git" path the route was resolved for
+	Repository string
+	// UpstreamBaseURL is the rendered upstream template
+	UpstreamBaseURL string
+}
+
+// Table resolves repositories to routes, exact matches take precedence over prefixes
+// and longer prefixes over shorter ones
+type Table struct {
+	exact    map[string]*Route
+	prefixes []*Route
+}
+
+type tableFile struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// LoadTable reads a YAML (or JSON) routing table
+func LoadTable(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tableFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing routing table: %w", err)
+	}
+
+	return NewTable(file.Routes)
+}
+
+func NewTable(routes []Route) (*Table, error) {
+	t := &Table{
+		exact: map[string]*Route{},
+	}
+
+	for i := range routes {
+		route := &routes[i]
+
+		if route.Upstream == "" {
+			return nil, fmt.Errorf("route %d has no upstream", i)
+		}
+
+		if u, err := url.Parse(render(route.Upstream, "owner", "repo")); err != nil {
+			return nil, fmt.Errorf("route %d has an invalid upstream: %w", i, err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("route %d has an invalid upstream: unsupported scheme %q", i, u.Scheme)
+		}
+
+		if route.Repository != "" {
+			if route.Prefix != "" {
+				return nil, fmt.Errorf("route %d sets both repository and prefix", i)
+			}
+
+			if _, dup := t.exact[route.Repository]; dup {
+				return nil, fmt.Errorf("route %d duplicates repository %v", i, route.Repository)
+			}
+
+			t.exact[route.Repository] = route
+			continue
+		}
+
+		t.prefixes = append(t.prefixes, route)
+	}
+
+	sort.SliceStable(t.prefixes, func(i, j int) bool {
+		return len(t.prefixes[i].Prefix) > len(t.prefixes[j].Prefix)
+	})
+
+	return t, nil
+}
+
+// underPrefix reports whether repository is prefix or lies under it
+func underPrefix(repository string, prefix string) bool {
+	if prefix == "" || repository == prefix {
+		return true
+	}
+
+	if !strings.HasPrefix(repository, prefix) {
+		return false
+	}
+
+	return strings.HasSuffix(prefix, "/") || repository[len(prefix)] == '/'
+}
+
+// Resolve finds the route of the owner/repo repository and renders its upstream
+func (t *Table) Resolve(owner string, repo string) (*Resolved, error) {
+	if !repositorySegment.MatchString(owner) || !repositorySegment.MatchString(repo) || owner == ".." || repo == ".." {
+		return nil, ErrInvalidRepository
+	}
+
+	repository := owner + "/" + repo
+
+	route, ok := t.exact[repository]
+	if !ok {
+		for _, prefix := range t.prefixes {
+			if underPrefix(repository, prefix.Prefix) {
+				route, ok = prefix, true
+				break
+			}
+		}
+	}
+
+	if !ok {
+		return nil, ErrNoRoute
+	}
+
+	return &Resolved{
+		Route:           route,
+		Repository:      repository,
+		UpstreamBaseURL: render(route.Upstream, owner, strings.TrimSuffix(repo, ".git")),
+	}, nil
+}
+
+var namespaceUnsafe = regexp.MustCompile(`[^A-Za-z0-9._/-]`)
+
+// Namespace returns the key namespace of the repository at upstreamBaseURL,
+// for example github.com/vela-games/game.git for https://github.com/vela-games/game.git/info/lfs/
+func Namespace(upstreamBaseURL string) string {
+	u, err := url.Parse(upstreamBaseURL)
+	if err != nil {
+		return namespaceUnsafe.ReplaceAllString(upstreamBaseURL, "_")
+	}
+
+	p := strings.TrimSuffix(strings.Trim(u.Path, "/"), "/info/lfs")
+
+	var segments []string
+	for _, segment := range strings.Split(namespaceUnsafe.ReplaceAllString(u.Host+"/"+p, "_"), "/") {
+		if segment != "" && segment != "." && segment != ".." {
+			segments = append(segments, segment)
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func render(upstream string, owner string, repo string) string {
+	return strings.NewReplacer("{owner}", owner, "{repo}", repo).Replace(upstream)
+}
+
+// Buckets returns the distinct bucket overrides used by the table
+func (t *Table) Buckets() []string {
+	seen := map[string]struct{}{}
+	var buckets []string
+
+	routes := append([]*Route{}, t.prefixes...)
+	for _, route := range t.exact {
+		routes = append(routes, route)
+	}
+
+	for _, route := range routes {
+		if _, ok := seen[route.Bucket]; route.Bucket == "" || ok {
+			continue
+		}
+		seen[route.Bucket] = struct{}{}
+		buckets = append(buckets, route.Bucket)
+	}
+
+	sort.Strings(buckets)
+
+	return buckets
+}
@@ -0,0 +1,112 @@
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTable builds the routing table of the tests, each test gets a table of its own
+func newTestTable(t *testing.T) *Table {
+	table, err := NewTable([]Route{
+		{Prefix: "", Upstream: "https://github.com/{owner}/{repo}.git/info/lfs/"},
+		{Prefix: "vela-games/", Upstream: "https://{owner}.git.example.com/{repo}.git/info/lfs/", KeyPrefix: "vela"},
+		{Prefix: "vela-games/game", Upstream: "https://git.example.com/game/info/lfs/"},
+		{Repository: "vela-games/game.git", Upstream: "https://github.com/vela-games/game.git/info/lfs/", Bucket: "game-lfs"},
+	})
+	require.NoError(t, err)
+
+	return table
+}
+
+func TestTable(t *testing.T) {
+	t.Run("exact matches take precedence", func(t *testing.T) {
+		route, err := newTestTable(t).Resolve("vela-games", "game.git")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://github.com/vela-games/game.git/info/lfs/", route.UpstreamBaseURL)
+		assert.Equal(t, "game-lfs", route.Bucket)
+		assert.Equal(t, "vela-games/game.git", route.Repository)
+	})
+
+	t.Run("longest prefix wins and templates the host", func(t *testing.T) {
+		route, err := newTestTable(t).Resolve("vela-games", "tools.git")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://vela-games.git.example.com/tools.git/info/lfs/", route.UpstreamBaseURL)
+		assert.Equal(t, "vela", route.KeyPrefix)
+	})
+
+	t.Run("prefixes only match whole path segments", func(t *testing.T) {
+		table := newTestTable(t)
+
+		route, err := table.Resolve("vela-games", "game")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://git.example.com/game/info/lfs/", route.UpstreamBaseURL)
+
+		route, err = table.Resolve("vela-games", "game-private.git")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://vela-games.git.example.com/game-private.git/info/lfs/", route.UpstreamBaseURL)
+	})
+
+	t.Run("catch-all prefix", func(t *testing.T) {
+		route, err := newTestTable(t).Resolve("someone", "else")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://github.com/someone/else.git/info/lfs/", route.UpstreamBaseURL)
+	})
+
+	t.Run("it should reject repositories that could alter the upstream", func(t *testing.T) {
+		table := newTestTable(t)
+
+		for _, owner := range []string{"evil.com/", "..", "a@b", "a:b", ""} {
+			_, err := table.Resolve(owner, "repo.git")
+			assert.ErrorIs(t, err, ErrInvalidRepository, owner)
+		}
+	})
+
+	t.Run("it should fail when nothing matches", func(t *testing.T) {
+		table, err := NewTable([]Route{{Prefix: "vela-games/", Upstream: "https://github.com/{owner}/{repo}.git/info/lfs/"}})
+		require.NoError(t, err)
+
+		_, err = table.Resolve("someone", "else.git")
+		assert.ErrorIs(t, err, ErrNoRoute)
+	})
+
+	t.Run("it should list the buckets overridden by routes", func(t *testing.T) {
+		assert.Equal(t, []string{"game-lfs"}, newTestTable(t).Buckets())
+	})
+}
+
+func TestLoadTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+routes:
+  - repository: vela-games/game.git
+    upstream: https://github.com/vela-games/game.git/info/lfs/
+    bucket: game-lfs
+  - prefix: ""
+    upstream: https://github.com/{owner}/{repo}.git/info/lfs/
+    key_prefix: shared
+`), 0o600))
+
+	table, err := LoadTable(path)
+	require.NoError(t, err)
+
+	route, err := table.Resolve("vela-games", "other.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "shared", route.KeyPrefix)
+
+	_, err = NewTable([]Route{{Repository: "a/b.git", Prefix: "a/", Upstream: "https://example.com"}})
+	assert.Error(t, err)
+
+	_, err = NewTable([]Route{{Repository: "a/b.git"}})
+	assert.Error(t, err)
+}
+
+func TestNamespace(t *testing.T) {
+	assert.Equal(t, "github.com/vela-games/game.git", Namespace("https://github.com/vela-games/game.git/info/lfs/"))
+	assert.Equal(t, "github.com/vela-games/game.git", Namespace("https://github.com/vela-games/game.git/info/lfs"))
+	assert.Equal(t, "git.lan_8443/lfs/game", Namespace("https://git.lan:8443/lfs/game/"))
+	assert.Equal(t, "git.lan/a/b", Namespace("https://git.lan/a/../b/"))
+}
@@ -1,8 +1,16 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,18 +19,71 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/vela-games/lfsproxy/config"
 )
 
+func init() {
+	RegisterObjectStore("s3", func(cfg *config.Config, bucket string) (ObjectStore, error) {
+		if bucket == "" {
+			bucket = cfg.S3Bucket
+		}
+
+		if bucket == "" {
+			return nil, errors.New("APP_S3_BUCKET is required by the s3 storage backend")
+		}
+
+		var signer *HrefSigner
+		if cfg.S3StreamingEnabled {
+			var err error
+			if signer, err = NewHrefSignerFromConfig(cfg); err != nil {
+				return nil, err
+			}
+		}
+
+		return NewAWSService(AWSOptions{
+			Bucket:            bucket,
+			UseAccelerate:     cfg.S3UseAccelerate,
+			PresignEnabled:    cfg.S3PresignEnabled,
+			PresignExpiration: cfg.S3PresignExpiration,
+			Endpoint:          cfg.S3Endpoint,
+			ForcePathStyle:    cfg.S3ForcePathStyle,
+			PublicBaseURL:     cfg.S3PublicBaseURL,
+			Streaming:         cfg.S3StreamingEnabled,
+			Signer:            signer,
+		})
+	})
+}
+
+// leasePrefix is where AcquireLease keeps lease objects, away from the objects themselves
+const leasePrefix = ".leases/"
+
 type S3 interface {
 	HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
 	HeadObjectRequest(input *s3.HeadObjectInput) (req *request.Request, output *s3.HeadObjectOutput)
 	GetObjectRequest(input *s3.GetObjectInput) (req *request.Request, output *s3.GetObjectOutput)
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+	PutObjectRequest(input *s3.PutObjectInput) (req *request.Request, output *s3.PutObjectOutput)
+	DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
 }
 
-type AWSService interface {
-	OIDExists(oid string) (bool, error)
-	GetOIDPreSignedURL(oid string) (string, string, error)
-	UploadOID(oid string, body io.ReadCloser) error
+// AWSOptions configures the S3 object store
+type AWSOptions struct {
+	Bucket            string
+	UseAccelerate     bool
+	PresignEnabled    bool
+	PresignExpiration time.Duration
+
+	// Endpoint of an S3-compatible service (MinIO, Ceph, R2), empty for AWS S3
+	Endpoint string
+	// ForcePathStyle uses {endpoint}/{bucket}/{key} URLs instead of virtual-hosted {bucket}.{endpoint}/{key}
+	ForcePathStyle bool
+	// PublicBaseURL is the endpoint clients reach the store at, when it differs from the one the proxy uses
+	PublicBaseURL string
+	// Streaming serves objects through the proxy with its own credentials instead of handing out S3 URLs,
+	// Signer signs the hrefs to the proxy
+	Streaming bool
+	Signer    *HrefSigner
 }
 
 type AWS struct {
@@ -30,31 +91,63 @@ type AWS struct {
 	useAccelerate     bool
 	presignEnabled    bool
 	presignExpiration time.Duration
+	endpoint          string
+	forcePathStyle    bool
+	publicBaseURL     string
 	s3Client          S3
-	awsSession        *session.Session
+	presignClient     S3
+	uploader          *s3manager.Uploader
 	awsRegion         string
 }
 
-func NewAWSService(bucket string, useAccelerate bool, presignEnabled bool, presignExpiration time.Duration) (AWSService, error) {
+func NewAWSService(opts AWSOptions) (ObjectStore, error) {
 	session, err := GetAWSSession()
 	if err != nil {
 		return nil, err
 	}
 
-	s3Client := s3.New(session, &aws.Config{
+	s3Config := &aws.Config{
 		DisableRestProtocolURICleaning: aws.Bool(true),
-		S3UseAccelerate:                aws.Bool(useAccelerate),
-	})
+		S3UseAccelerate:                aws.Bool(opts.UseAccelerate),
+		S3ForcePathStyle:               aws.Bool(opts.ForcePathStyle),
+	}
+	if opts.Endpoint != "" {
+		s3Config.Endpoint = aws.String(opts.Endpoint)
+	}
 
-	return &AWS{
-		awsSession:        session,
-		bucket:            bucket,
-		useAccelerate:     useAccelerate,
-		presignEnabled:    presignEnabled,
-		presignExpiration: presignExpiration,
+	s3Client := s3.New(session, s3Config)
+
+	// Presigned URLs sign the host, so they have to be generated against the endpoint clients use
+	var presignClient S3 = s3Client
+	if opts.PublicBaseURL != "" {
+		presignClient = s3.New(session, s3Config.Copy(&aws.Config{
+			Endpoint: aws.String(opts.PublicBaseURL),
+		}))
+	}
+
+	store := &AWS{
+		bucket:            opts.Bucket,
+		useAccelerate:     opts.UseAccelerate,
+		presignEnabled:    opts.PresignEnabled,
+		presignExpiration: opts.PresignExpiration,
+		endpoint:          opts.Endpoint,
+		forcePathStyle:    opts.ForcePathStyle,
+		publicBaseURL:     opts.PublicBaseURL,
 		s3Client:          s3Client,
-		awsRegion:         *session.Config.Region,
-	}, nil
+		presignClient:     presignClient,
+		uploader:          s3manager.NewUploaderWithClient(s3Client),
+		awsRegion:         aws.StringValue(session.Config.Region),
+	}
+
+	if opts.Streaming {
+		if opts.Signer == nil {
+			return nil, errors.New("a signer is required to stream objects through the proxy")
+		}
+
+		return &StreamingAWS{AWS: store, signer: opts.Signer}, nil
+	}
+
+	return store, nil
 }
 
 func GetAWSSession() (*session.Session, error) {
@@ -89,13 +182,27 @@ func (a AWS) OIDExists(oid string) (bool, error) {
 	return true, nil
 }
 
+// URLExpiration is zero when presigning is disabled, objects are then served by their plain URL
+func (a AWS) URLExpiration() time.Duration {
+	if !a.presignEnabled {
+		return 0
+	}
+
+	return a.presignExpiration
+}
+
 func (a AWS) GetOIDPreSignedURL(oid string) (string, string, error) {
 	var urlStr, headUrlStr string
 
 	if a.presignEnabled {
 		var err error
 
-		req, _ := a.s3Client.GetObjectRequest(&s3.GetObjectInput{
+		presignClient := a.presignClient
+		if presignClient == nil {
+			presignClient = a.s3Client
+		}
+
+		req, _ := presignClient.GetObjectRequest(&s3.GetObjectInput{
 			Bucket: aws.String(a.bucket),
 			Key:    aws.String(oid),
 		})
@@ -106,7 +213,7 @@ func (a AWS) GetOIDPreSignedURL(oid string) (string, string, error) {
 			return "", "", err
 		}
 
-		req, _ = a.s3Client.HeadObjectRequest(&s3.HeadObjectInput{
+		req, _ = presignClient.HeadObjectRequest(&s3.HeadObjectInput{
 			Bucket: aws.String(a.bucket),
 			Key:    aws.String(oid),
 		})
@@ -115,6 +222,14 @@ func (a AWS) GetOIDPreSignedURL(oid string) (string, string, error) {
 		if err != nil {
 			return "", "", err
 		}
+	} else if baseURL := a.customBaseURL(); baseURL != "" {
+		var err error
+
+		urlStr, err = a.customObjectURL(baseURL, oid)
+		if err != nil {
+			return "", "", err
+		}
+		headUrlStr = urlStr
 	} else if a.useAccelerate {
 		urlStr = fmt.Sprintf("https://%s.s3-accelerate.amazonaws.com/%s", a.bucket, oid)
 		headUrlStr = urlStr
@@ -126,20 +241,159 @@ func (a AWS) GetOIDPreSignedURL(oid string) (string, string, error) {
 	return urlStr, headUrlStr, nil
 }
 
+// customBaseURL returns the endpoint unsigned URLs are built from for S3-compatible services
+func (a AWS) customBaseURL() string {
+	if a.publicBaseURL != "" {
+		return a.publicBaseURL
+	}
+
+	return a.endpoint
+}
+
+func (a AWS) customObjectURL(baseURL string, oid string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+
+	if a.forcePathStyle {
+		u.Path = path.Join("/", u.Path, a.bucket, oid)
+	} else {
+		u.Host = a.bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, oid)
+	}
+
+	return u.String(), nil
+}
+
 func (a AWS) UploadOID(oid string, body io.ReadCloser) error {
 	defer body.Close()
 
-	uploader := s3manager.NewUploader(a.awsSession)
-
-	_, err := uploader.Upload(&s3manager.UploadInput{
+	_, err := a.uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(a.bucket),
 		Key:    aws.String(oid),
 		Body:   body,
 	})
 	if err != nil {
-		fmt.Printf("error uploading: %v\n", err.Error())
+		slog.ErrorContext(context.Background(), "error uploading object", "key", oid, "error", err)
+
+		// The uploader wraps the read error of the body, which doesn't unwrap in aws-sdk-go v1
+		if cause := awsCause(err); errors.Is(cause, ErrContentMismatch) {
+			return cause
+		}
+
 		return err
 	}
 
 	return nil
 }
+
+// awsCause returns the error an awserr.Error was originally caused by
+func awsCause(err error) error {
+	for {
+		aerr, ok := err.(awserr.Error) //nolint:errorlint
+		if !ok || aerr.OrigErr() == nil {
+			return err
+		}
+
+		err = aerr.OrigErr()
+	}
+}
+
+// AcquireLease writes a lease object next to the objects with a conditional write, so only one replica can hold it.
+// Expired leases are taken over with a write conditioned on the ETag of the expired lease
+func (a AWS) AcquireLease(oid string, ttl time.Duration) (bool, error) {
+	key := leasePrefix + oid
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	acquired, err := a.putLease(key, expires, "If-None-Match", "*")
+	if err != nil || acquired {
+		return acquired, err
+	}
+
+	lease, err := a.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey { //nolint:errorlint
+			// Released in the meantime
+			return a.putLease(key, expires, "If-None-Match", "*")
+		}
+
+		return false, err
+	}
+	defer lease.Body.Close()
+
+	data, err := io.ReadAll(lease.Body)
+	if err != nil {
+		return false, err
+	}
+
+	if leaseExpires, err := strconv.ParseInt(string(data), 10, 64); err == nil && time.Now().Unix() < leaseExpires {
+		return false, nil
+	}
+
+	return a.putLease(key, expires, "If-Match", aws.StringValue(lease.ETag))
+}
+
+// RenewLease extends a lease that hasn't expired yet, which no one else can have taken over
+func (a AWS) RenewLease(oid string, ttl time.Duration) (bool, error) {
+	key := leasePrefix + oid
+
+	lease, err := a.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey { //nolint:errorlint
+			return false, nil
+		}
+
+		return false, err
+	}
+	defer lease.Body.Close()
+
+	data, err := io.ReadAll(lease.Body)
+	if err != nil {
+		return false, err
+	}
+
+	if leaseExpires, err := strconv.ParseInt(string(data), 10, 64); err != nil || time.Now().Unix() >= leaseExpires {
+		return false, nil
+	}
+
+	return a.putLease(key, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10), "If-Match", aws.StringValue(lease.ETag))
+}
+
+func (a AWS) ReleaseLease(oid string) error {
+	_, err := a.s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(leasePrefix + oid),
+	})
+
+	return err
+}
+
+// putLease writes a lease object under a precondition, a failed precondition means the lease is held by someone else
+func (a AWS) putLease(key string, expires string, condition string, value string) (bool, error) {
+	req, _ := a.s3Client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(expires),
+	})
+	req.HTTPRequest.Header.Set(condition, value)
+
+	if err := req.Send(); err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok { //nolint:errorlint
+			switch aerr.StatusCode() {
+			case http.StatusPreconditionFailed, http.StatusConflict:
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// StreamingAWS is an S3 object store whose objects are served by the proxy with its own credentials,
+// so the bucket can stay private without handing out presigned URLs
+type StreamingAWS struct {
+	*AWS
+	signer *HrefSigner
+}
+
+func (s StreamingAWS) GetOIDPreSignedURL(oid string) (string, string, error) {
+	urlStr := s.signer.Sign(path.Join("/objects", oid))
+
+	return urlStr, urlStr, nil
+}
+
+func (s StreamingAWS) URLExpiration() time.Duration {
+	return s.signer.Expiration()
+}
+
+// OpenOID returns a reader downloading the object lazily, starting from wherever it was seeked to,
+// so Range and HEAD requests only download what they need
+func (s StreamingAWS) OpenOID(ctx context.Context, oid string) (io.ReadSeekCloser, ObjectInfo, error) {
+	head, err := s.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(oid),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" { //nolint:errorlint
+			return nil, ObjectInfo{}, ErrObjectNotFound
+		}
+
+		return nil, ObjectInfo{}, err
+	}
+
+	reader := &s3RangeReader{
+		ctx:    ctx,
+		client: s.s3Client,
+		bucket: s.bucket,
+		key:    oid,
+		etag:   head.ETag,
+		size:   aws.Int64Value(head.ContentLength),
+	}
+
+	return reader, ObjectInfo{Size: reader.size, ModTime: aws.TimeValue(head.LastModified)}, nil
+}
+
+// s3RangeReader reads an S3 object from its offset with a ranged GetObject, sent on the first read after a seek.
+// Ranges end with the object, or with the hinted range when reading within it, see HintRange
+type s3RangeReader struct {
+	ctx    context.Context
+	client S3
+	bucket string
+	key    string
+	// etag pins the reads to the object that was opened in case it is overwritten meanwhile
+	etag   *string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+
+	hintStart int64
+	hintEnd   int64
+}
+
+// HintRange bounds the ranges read from within start and end to end
+func (r *s3RangeReader) HintRange(start int64, end int64) {
+	r.hintStart, r.hintEnd = start, min(end, r.size)
+}
+
+func (r *s3RangeReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		end := r.size
+		if r.offset >= r.hintStart && r.offset < r.hintEnd {
+			end = r.hintEnd
+		}
+
+		output, err := r.client.GetObjectWithContext(r.ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(r.bucket),
+			Key:     aws.String(r.key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", r.offset, end-1)),
+			IfMatch: r.etag,
+		})
+		if err != nil {
+			return 0, err
+		}
+		r.body = output.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+
+	// Reads going past the hinted range continue with another range
+	if errors.Is(err, io.EOF) && r.offset < r.size {
+		r.Close() //nolint:errcheck
+		if n > 0 {
+			return n, nil
+		}
+
+		return r.Read(p)
+	}
+
+	return n, err
+}
+
+func (r *s3RangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if offset != r.offset {
+		r.Close() //nolint:errcheck
+		r.offset = offset
+	}
+
+	return offset, nil
+}
+
+func (r *s3RangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+
+	return err
+}
@@ -1,6 +1,15 @@
 package services
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -60,6 +69,30 @@ func (m MockS3Client) GetObjectRequest(input *s3.GetObjectInput) (req *request.R
 	return
 }
 
+func (m MockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return nil, awserr.New(s3.ErrCodeNoSuchKey, "Object not found", nil)
+}
+
+func (m MockS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return m.GetObject(input)
+}
+
+func (m MockS3Client) PutObjectRequest(input *s3.PutObjectInput) (req *request.Request, output *s3.PutObjectOutput) {
+	op := &request.Operation{
+		Name:       "PutObject",
+		HTTPMethod: "PUT",
+		HTTPPath:   "/{Bucket}/{Key+}",
+	}
+
+	output = &s3.PutObjectOutput{}
+	req = request.New(*aws.NewConfig(), metadata.ClientInfo{}, request.Handlers{}, nil, op, input, output)
+	return
+}
+
+func (m MockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return &s3.DeleteObjectOutput{}, nil
+}
+
 func TestOIDExists(t *testing.T) {
 	t.Run("OIDExists return false because OID doesn't exist", func(t *testing.T) {
 		mockS3Client := MockS3Client{
@@ -165,6 +198,67 @@ func TestGetOIDPreSignedURL(t *testing.T) {
 	})
 }
 
+func TestGetOIDPreSignedURLCustomEndpoint(t *testing.T) {
+	t.Run("Returns non-presign path-style urls for custom endpoints", func(t *testing.T) {
+		awsService := AWS{
+			bucket:         "test-bucket",
+			s3Client:       MockS3Client{beforePresign: itShouldNotPresign(t)},
+			presignEnabled: false,
+			useAccelerate:  true,
+			endpoint:       "http://minio.lan:9000",
+			forcePathStyle: true,
+			awsRegion:      "us-east-1",
+		}
+
+		urlStr, headUrlStr, err := awsService.GetOIDPreSignedURL("test-oid")
+		assert.NoError(t, err)
+		assert.Equal(t, "http://minio.lan:9000/test-bucket/test-oid", urlStr)
+		assert.Equal(t, "http://minio.lan:9000/test-bucket/test-oid", headUrlStr)
+	})
+
+	t.Run("Returns non-presign virtual-hosted urls on the public base url", func(t *testing.T) {
+		awsService := AWS{
+			bucket:         "test-bucket",
+			s3Client:       MockS3Client{beforePresign: itShouldNotPresign(t)},
+			presignEnabled: false,
+			endpoint:       "http://minio.internal:9000",
+			publicBaseURL:  "https://objects.example.com",
+			awsRegion:      "us-east-1",
+		}
+
+		urlStr, _, err := awsService.GetOIDPreSignedURL("test-oid")
+		assert.NoError(t, err)
+		assert.Equal(t, "https://test-bucket.objects.example.com/test-oid", urlStr)
+	})
+
+	t.Run("Returns presign urls on the public base url", func(t *testing.T) {
+		t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+		t.Setenv("AWS_REGION", "auto")
+
+		awsService, err := NewAWSService(AWSOptions{
+			Bucket:            "test-bucket",
+			PresignEnabled:    true,
+			PresignExpiration: 1 * time.Hour,
+			Endpoint:          "http://minio.internal:9000",
+			ForcePathStyle:    true,
+			PublicBaseURL:     "https://objects.example.com",
+		})
+		assert.NoError(t, err)
+
+		urlStr, headUrlStr, err := awsService.GetOIDPreSignedURL("test-oid")
+		assert.NoError(t, err)
+
+		for _, s := range []string{urlStr, headUrlStr} {
+			u, err := url.Parse(s)
+			assert.NoError(t, err)
+			assert.Equal(t, "objects.example.com", u.Host)
+			assert.Equal(t, "/test-bucket/test-oid", u.Path)
+			assert.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+		}
+	})
+}
+
 // Not sure how to mock presign of URLs so we just take advantage of BeforePresignFn to check if
 // Sign is being called or not
 func itShouldNotPresign(t *testing.T) func(r *request.Request) error {
@@ -180,3 +274,277 @@ func itShouldPresign(t *testing.T, counter *int) func(r *request.Request) error
 		return nil
 	}
 }
+
+// fakeConditionalS3 is an S3 endpoint storing objects in memory that honors If-None-Match and If-Match on writes
+type fakeConditionalS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	writes  int
+	// ranges are the Range headers of the reads received
+	ranges []string
+}
+
+func (f *fakeConditionalS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := r.URL.Path
+	_, exists := f.objects[key]
+
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if etag := r.Header.Get("If-Match"); etag != "" && etag != f.etags[key] {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		f.writes++
+		f.objects[key] = body
+		f.etags[key] = fmt.Sprintf(`"%d"`, f.writes)
+		w.Header().Set("ETag", f.etags[key])
+	case "GET", "HEAD":
+		if r.Method == "GET" {
+			f.ranges = append(f.ranges, r.Header.Get("Range"))
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("ETag", f.etags[key])
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.objects[key]))
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestAcquireLease(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	fake := &fakeConditionalS3{objects: map[string][]byte{}, etags: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store, err := NewAWSService(AWSOptions{
+		Bucket:         "test-bucket",
+		Endpoint:       srv.URL,
+		ForcePathStyle: true,
+	})
+	assert.NoError(t, err)
+
+	leaser := store.(Leaser)
+
+	t.Run("it should grant a lease to a single holder", func(t *testing.T) {
+		acquired, err := leaser.AcquireLease("test-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+
+		acquired, err = leaser.AcquireLease("test-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, acquired)
+
+		assert.Contains(t, fake.objects, "/test-bucket/.leases/test-oid")
+	})
+
+	t.Run("it should grant released leases again", func(t *testing.T) {
+		assert.NoError(t, leaser.ReleaseLease("test-oid"))
+
+		acquired, err := leaser.AcquireLease("test-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+		assert.NoError(t, leaser.ReleaseLease("test-oid"))
+	})
+
+	t.Run("it should take over expired leases", func(t *testing.T) {
+		acquired, err := leaser.AcquireLease("expiring-oid", -1*time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+
+		acquired, err = leaser.AcquireLease("expiring-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+
+		acquired, err = leaser.AcquireLease("expiring-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, acquired)
+	})
+
+	t.Run("it should lease prefixed objects under their prefix", func(t *testing.T) {
+		acquired, err := AcquireLease(NewPrefixedStore(store, "repository.git"), "test-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+
+		assert.Contains(t, fake.objects, "/test-bucket/.leases/repository.git/test-oid")
+	})
+
+	t.Run("it should renew leases until they are lost", func(t *testing.T) {
+		acquired, err := leaser.AcquireLease("renewed-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+
+		renewed, err := leaser.RenewLease("renewed-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, renewed)
+
+		acquired, err = leaser.AcquireLease("renewed-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, acquired)
+
+		assert.NoError(t, leaser.ReleaseLease("renewed-oid"))
+		renewed, err = leaser.RenewLease("renewed-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, renewed)
+
+		// Expired leases may have been taken over
+		_, err = leaser.AcquireLease("renewed-oid", -1*time.Minute)
+		assert.NoError(t, err)
+		renewed, err = leaser.RenewLease("renewed-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, renewed)
+	})
+
+	t.Run("it should always grant leases on stores without lease support", func(t *testing.T) {
+		acquired, err := AcquireLease(fakeObjectStore{}, "test-oid", 1*time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, acquired)
+	})
+
+	t.Run("it should tell stores holding leases apart", func(t *testing.T) {
+		assert.True(t, SupportsLeases(store))
+		assert.True(t, SupportsLeases(NewPrefixedStore(store, "repository.git")))
+		assert.False(t, SupportsLeases(fakeObjectStore{}))
+		assert.False(t, SupportsLeases(NewPrefixedStore(fakeObjectStore{}, "repository.git")))
+	})
+}
+
+func TestStreamingAWS(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	fake := &fakeConditionalS3{objects: map[string][]byte{}, etags: map[string]string{}}
+	fake.objects["/test-bucket/test-oid"] = []byte("0123456789")
+	fake.etags["/test-bucket/test-oid"] = `"1"`
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	t.Run("it should require a signer", func(t *testing.T) {
+		_, err := NewAWSService(AWSOptions{Bucket: "test-bucket", Endpoint: srv.URL, ForcePathStyle: true, Streaming: true})
+		assert.Error(t, err)
+	})
+
+	store, err := NewAWSService(AWSOptions{
+		Bucket:         "test-bucket",
+		Endpoint:       srv.URL,
+		ForcePathStyle: true,
+		Streaming:      true,
+		Signer:         NewHrefSigner("https://lfsproxy.lan", []byte("test-key"), time.Hour),
+	})
+	assert.NoError(t, err)
+
+	t.Run("it should return signed hrefs to the proxy", func(t *testing.T) {
+		urlStr, headUrlStr, err := store.GetOIDPreSignedURL("test-oid")
+		assert.NoError(t, err)
+		assert.Equal(t, urlStr, headUrlStr)
+
+		u, err := url.Parse(urlStr)
+		assert.NoError(t, err)
+		assert.Equal(t, "lfsproxy.lan", u.Host)
+		assert.Equal(t, "/objects/test-oid", u.Path)
+		assert.NotEmpty(t, u.Query().Get("signature"))
+	})
+
+	t.Run("it should read objects from where they were seeked to", func(t *testing.T) {
+		body, info, err := store.(ObjectOpener).OpenOID(context.Background(), "test-oid")
+		assert.NoError(t, err)
+		defer body.Close()
+		assert.Equal(t, int64(10), info.Size)
+
+		_, err = body.Seek(6, io.SeekStart)
+		assert.NoError(t, err)
+
+		data, err := io.ReadAll(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "6789", string(data))
+
+		_, err = body.Seek(2, io.SeekStart)
+		assert.NoError(t, err)
+
+		data = make([]byte, 3)
+		_, err = io.ReadFull(body, data)
+		assert.NoError(t, err)
+		assert.Equal(t, "234", string(data))
+	})
+
+	t.Run("it should only download the hinted range", func(t *testing.T) {
+		fake.ranges = nil
+
+		body, _, err := store.(ObjectOpener).OpenOID(context.Background(), "test-oid")
+		assert.NoError(t, err)
+		defer body.Close()
+
+		body.(RangeHinter).HintRange(2, 5)
+		_, err = body.Seek(2, io.SeekStart)
+		assert.NoError(t, err)
+
+		data := make([]byte, 3)
+		_, err = io.ReadFull(body, data)
+		assert.NoError(t, err)
+		assert.Equal(t, "234", string(data))
+		assert.Equal(t, []string{"bytes=2-4"}, fake.ranges)
+
+		// Reading past the hinted range downloads the rest of the object
+		data, err = io.ReadAll(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "56789", string(data))
+		assert.Equal(t, []string{"bytes=2-4", "bytes=5-9"}, fake.ranges)
+	})
+
+	t.Run("it should not find missing objects", func(t *testing.T) {
+		_, _, err := store.(ObjectOpener).OpenOID(context.Background(), "missing-oid")
+		assert.ErrorIs(t, err, ErrObjectNotFound)
+	})
+}
+
+func TestUploadOID(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	fake := &fakeConditionalS3{objects: map[string][]byte{}, etags: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store, err := NewAWSService(AWSOptions{
+		Bucket:         "test-bucket",
+		Endpoint:       srv.URL,
+		ForcePathStyle: true,
+	})
+	assert.NoError(t, err)
+
+	// sha256 of "0123456789"
+	oid := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+	for _, content := range []string{"0123456780", "01234", "01234567890"} {
+		t.Run("it should report mismatching content "+content, func(t *testing.T) {
+			err := store.UploadOID(oid, NewVerifyingReader(io.NopCloser(strings.NewReader(content)), oid, 10))
+			assert.ErrorIs(t, err, ErrContentMismatch)
+			assert.NotContains(t, fake.objects, "/test-bucket/"+oid)
+		})
+	}
+
+	t.Run("it should upload matching content", func(t *testing.T) {
+		err := store.UploadOID(oid, NewVerifyingReader(io.NopCloser(strings.NewReader("0123456789")), oid, 10))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0123456789"), fake.objects["/test-bucket/"+oid])
+	})
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/vela-games/lfsproxy/config"
+)
+
+func init() {
+	RegisterObjectStore("azure", func(cfg *config.Config, bucket string) (ObjectStore, error) {
+		if bucket == "" {
+			bucket = cfg.AzureContainer
+		}
+
+		if bucket == "" || cfg.AzureAccountName == "" || cfg.AzureAccountKey == "" {
+			return nil, errors.New("APP_AZURE_CONTAINER, APP_AZURE_ACCOUNT_NAME and APP_AZURE_ACCOUNT_KEY are required by the azure storage backend")
+		}
+
+		return NewAzureService(cfg.AzureServiceURL, cfg.AzureAccountName, cfg.AzureAccountKey, bucket, cfg.AzureSASExpiration)
+	})
+}
+
+// Azure stores objects as block blobs on an Azure Storage container and hands out read-only SAS URLs to them
+type Azure struct {
+	sasExpiration   time.Duration
+	containerClient *container.Client
+}
+
+// NewAzureService builds an Azure Blob object store authenticated with the storage account shared key.
+// serviceURL defaults to the public Azure endpoint of the account, it can point to Azurite for local testing
+func NewAzureService(serviceURL string, accountName string, accountKey string, containerName string, sasExpiration time.Duration) (ObjectStore, error) {
+	if serviceURL == "" {
+		serviceURL = fmt.Sprintf("https://%s.blob.core.windows.net/", accountName)
+	}
+
+	cred, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := azblob.NewClientWithSharedKeyCredential(serviceURL, cred, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Azure{
+		sasExpiration:   sasExpiration,
+		containerClient: client.ServiceClient().NewContainerClient(containerName),
+	}, nil
+}
+
+func (a Azure) OIDExists(oid string) (bool, error) {
+	_, err := a.containerClient.NewBlobClient(oid).GetProperties(context.Background(), nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (a Azure) URLExpiration() time.Duration {
+	return a.sasExpiration
+}
+
+func (a Azure) GetOIDPreSignedURL(oid string) (string, string, error) {
+	// Read permission covers both Get Blob and Get Blob Properties,
+	// so the same SAS URL is valid for the download and the head href
+	urlStr, err := a.containerClient.NewBlobClient(oid).GetSASURL(sas.BlobPermissions{Read: true}, time.Now().Add(a.sasExpiration), nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	return urlStr, urlStr, nil
+}
+
+func (a Azure) UploadOID(oid string, body io.ReadCloser) error {
+	defer body.Close()
+
+	// Blocks are only committed once the whole body has been read,
+	// a failed read leaves uncommitted blocks that Azure garbage collects
+	_, err := a.containerClient.NewBlockBlobClient(oid).UploadStream(context.Background(), body, nil)
+
+	return err
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Well-known development account used by Azurite
+// https://learn.microsoft.com/en-us/azure/storage/common/storage-use-azurite#well-known-storage-account-and-key
+const (
+	azuriteAccountName = "devstoreaccount1"
+	azuriteAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+func TestAzureGetOIDPreSignedURL(t *testing.T) {
+	store, err := NewAzureService("http://127.0.0.1:10000/devstoreaccount1", azuriteAccountName, azuriteAccountKey, "test-container", 1*time.Hour)
+	require.NoError(t, err)
+
+	urlStr, headUrlStr, err := store.GetOIDPreSignedURL("test-oid")
+	assert.NoError(t, err)
+	assert.Equal(t, urlStr, headUrlStr)
+
+	u, err := url.Parse(urlStr)
+	assert.NoError(t, err)
+	assert.Equal(t, "/devstoreaccount1/test-container/test-oid", u.Path)
+	assert.Equal(t, "r", u.Query().Get("sp"))
+	assert.Equal(t, "b", u.Query().Get("sr"))
+	assert.NotEmpty(t, u.Query().Get("sig"))
+}
+
+// TestAzurite runs the backend against a running Azurite instance, for example:
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//	AZURITE_BLOB_SERVICE_URL=http://127.0.0.1:10000/devstoreaccount1 go test ./services/ -run TestAzurite
+func TestAzurite(t *testing.T) {
+	serviceURL := os.Getenv("AZURITE_BLOB_SERVICE_URL")
+	if serviceURL == "" {
+		t.Skip("AZURITE_BLOB_SERVICE_URL not set")
+	}
+
+	store, err := NewAzureService(serviceURL, azuriteAccountName, azuriteAccountKey, "lfsproxy-test", 1*time.Hour)
+	require.NoError(t, err)
+
+	azure := store.(*Azure)
+	_, err = azure.containerClient.Create(context.Background(), nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		require.NoError(t, err)
+	}
+
+	oid := "test-oid-" + time.Now().Format("20060102150405.000000000")
+
+	exists, err := store.OIDExists(oid)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	err = store.UploadOID(oid, io.NopCloser(bytes.NewBufferString("content")))
+	assert.NoError(t, err)
+
+	exists, err = store.OIDExists(oid)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	urlStr, headUrlStr, err := store.GetOIDPreSignedURL(oid)
+	assert.NoError(t, err)
+
+	resp, err := http.Get(urlStr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "content", string(body))
+
+	resp, err = http.Head(headUrlStr)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
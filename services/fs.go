@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vela-games/lfsproxy/config"
+)
+
+func init() {
+	RegisterObjectStore("fs", func(cfg *config.Config, bucket string) (ObjectStore, error) {
+		if cfg.FSRoot == "" {
+			return nil, errors.New("APP_FS_ROOT is required by the fs storage backend")
+		}
+
+		// Each bucket is stored on a sub-directory of the root
+		root := cfg.FSRoot
+		if bucket != "" {
+			root = filepath.Join(root, filepath.Base(bucket))
+		}
+
+		signer, err := NewHrefSignerFromConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewFSService(root, signer)
+	})
+}
+
+var fsKeySegment = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// FS stores objects on local disk under a sharded content-addressed layout (ab/cd/<oid>).
+// Objects are served by the proxy itself on GET /objects/{oid} using hrefs signed by HrefSigner
+type FS struct {
+	root   string
+	signer *HrefSigner
+}
+
+func NewFSService(root string, signer *HrefSigner) (*FS, error) {
+	if err := os.MkdirAll(filepath.Join(root, ".tmp"), 0o750); err != nil {
+		return nil, err
+	}
+
+	return &FS{
+		root:   root,
+		signer: signer,
+	}, nil
+}
+
+// objectPath maps an object key to its sharded location on disk.
+// Keys may contain a slash separated prefix, only the last element is sharded
+func (f FS) objectPath(oid string) (string, error) {
+	segments := strings.Split(oid, "/")
+	for _, segment := range segments {
+		if segment == "." || segment == ".." || !fsKeySegment.MatchString(segment) {
+			return "", fmt.Errorf("invalid object key %q", oid)
+		}
+	}
+
+	name := segments[len(segments)-1]
+	if len(name) < 5 {
+		return "", fmt.Errorf("invalid object key %q", oid)
+	}
+
+	dir := filepath.Join(segments[:len(segments)-1]...)
+
+	return filepath.Join(f.root, dir, name[0:2], name[2:4], name), nil
+}
+
+func (f FS) OIDExists(oid string) (bool, error) {
+	p, err := f.objectPath(oid)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (f FS) URLExpiration() time.Duration {
+	return f.signer.Expiration()
+}
+
+func (f FS) GetOIDPreSignedURL(oid string) (string, string, error) {
+	if _, err := f.objectPath(oid); err != nil {
+		return "", "", err
+	}
+
+	urlStr := f.signer.Sign(path.Join("/objects", oid))
+
+	return urlStr, urlStr, nil
+}
+
+func (f FS) UploadOID(oid string, body io.ReadCloser) error {
+	defer body.Close()
+
+	p, err := f.objectPath(oid)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first and move it in place once complete
+	// so a failed read never leaves a partial object behind
+	tmp, err := os.CreateTemp(filepath.Join(f.root, ".tmp"), "upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+// Stat returns the size and modification time of an object on disk
+func (f FS) Stat(oid string) (ObjectInfo, error) {
+	p, err := f.objectPath(oid)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	stat, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ObjectInfo{}, ErrObjectNotFound
+		}
+
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// Remove deletes an object from disk
+func (f FS) Remove(oid string) error {
+	p, err := f.objectPath(oid)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// FSObject is an object found on disk by List
+type FSObject struct {
+	ObjectInfo
+	Key string
+}
+
+// List returns every object stored on disk
+func (f FS) List() ([]FSObject, error) {
+	var objects []FSObject
+
+	err := filepath.WalkDir(f.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if p == filepath.Join(f.root, ".tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.root, p)
+		if err != nil {
+			return err
+		}
+
+		// Reverse the sharding, {prefix}/ab/cd/{name} is stored under the {prefix}/{name} key
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		if len(segments) < 3 {
+			return nil
+		}
+		key := path.Join(append(segments[:len(segments)-3], segments[len(segments)-1])...)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, FSObject{
+			Key:        key,
+			ObjectInfo: ObjectInfo{Size: info.Size(), ModTime: info.ModTime()},
+		})
+
+		return nil
+	})
+
+	return objects, err
+}
+
+func (f FS) OpenOID(ctx context.Context, oid string) (io.ReadSeekCloser, ObjectInfo, error) {
+	p, err := f.objectPath(oid)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ObjectInfo{}, ErrObjectNotFound
+		}
+
+		return nil, ObjectInfo{}, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	return file, ObjectInfo{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
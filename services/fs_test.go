@@ -0,0 +1,156 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOID = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+
+func TestFSService(t *testing.T) {
+	root := t.TempDir()
+	signer := NewHrefSigner("https://lfsproxy.example.com/", []byte("secret"), 1*time.Hour)
+
+	fs, err := NewFSService(root, signer)
+	require.NoError(t, err)
+
+	t.Run("it should store objects under a sharded layout", func(t *testing.T) {
+		p, err := fs.objectPath(testOID)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(root, "4d", "7a", testOID), p)
+
+		p, err = fs.objectPath("github.com/org/repo.git/" + testOID)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(root, "github.com", "org", "repo.git", "4d", "7a", testOID), p)
+	})
+
+	t.Run("it should reject keys escaping the root", func(t *testing.T) {
+		for _, key := range []string{"../" + testOID, "a/../../" + testOID, "/" + testOID, "abc"} {
+			_, err := fs.objectPath(key)
+			assert.Error(t, err, key)
+		}
+	})
+
+	t.Run("it should upload and open objects", func(t *testing.T) {
+		exists, err := fs.OIDExists(testOID)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+
+		err = fs.UploadOID(testOID, io.NopCloser(bytes.NewBufferString("content")))
+		assert.NoError(t, err)
+
+		exists, err = fs.OIDExists(testOID)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		body, info, err := fs.OpenOID(context.TODO(), testOID)
+		require.NoError(t, err)
+		defer body.Close()
+
+		data, err := io.ReadAll(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "content", string(data))
+		assert.Equal(t, int64(7), info.Size)
+	})
+
+	t.Run("it should not keep partial uploads", func(t *testing.T) {
+		oid := "0000000000000000000000000000000000000000000000000000000000000000"
+		err := fs.UploadOID(oid, io.NopCloser(io.MultiReader(bytes.NewBufferString("partial"), failingReader{})))
+		assert.Error(t, err)
+
+		exists, err := fs.OIDExists(oid)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+
+		tmp, err := filepath.Glob(filepath.Join(root, ".tmp", "*"))
+		assert.NoError(t, err)
+		assert.Empty(t, tmp)
+
+		_, _, err = fs.OpenOID(context.TODO(), oid)
+		assert.ErrorIs(t, err, ErrObjectNotFound)
+	})
+
+	t.Run("it should return signed hrefs served by the proxy", func(t *testing.T) {
+		urlStr, headUrlStr, err := fs.GetOIDPreSignedURL(testOID)
+		assert.NoError(t, err)
+		assert.Equal(t, urlStr, headUrlStr)
+
+		u, err := url.Parse(urlStr)
+		assert.NoError(t, err)
+		assert.Equal(t, "lfsproxy.example.com", u.Host)
+		assert.Equal(t, "/objects/"+testOID, u.Path)
+		assert.NoError(t, signer.Verify(u.Path, u.Query()))
+	})
+}
+
+func TestHrefSigner(t *testing.T) {
+	signer := NewHrefSigner("https://lfsproxy.example.com", []byte("secret"), 1*time.Hour)
+
+	u, err := url.Parse(signer.Sign("/objects/" + testOID))
+	require.NoError(t, err)
+
+	t.Run("it should accept valid signatures", func(t *testing.T) {
+		assert.NoError(t, signer.Verify(u.Path, u.Query()))
+	})
+
+	t.Run("it should reject signatures for other paths", func(t *testing.T) {
+		assert.ErrorIs(t, signer.Verify("/objects/other", u.Query()), ErrHrefInvalidSignature)
+	})
+
+	t.Run("it should reject tampered expirations", func(t *testing.T) {
+		query := u.Query()
+		query.Set("expires", "99999999999")
+		assert.ErrorIs(t, signer.Verify(u.Path, query), ErrHrefInvalidSignature)
+	})
+
+	t.Run("it should reject signatures made with another key", func(t *testing.T) {
+		other := NewHrefSigner("https://lfsproxy.example.com", []byte("other"), 1*time.Hour)
+		assert.ErrorIs(t, other.Verify(u.Path, u.Query()), ErrHrefInvalidSignature)
+	})
+
+	t.Run("it should reject expired hrefs", func(t *testing.T) {
+		expired := NewHrefSigner("https://lfsproxy.example.com", []byte("secret"), -1*time.Minute)
+		u, err := url.Parse(expired.Sign("/objects/" + testOID))
+		require.NoError(t, err)
+		assert.ErrorIs(t, expired.Verify(u.Path, u.Query()), ErrHrefExpired)
+	})
+
+	t.Run("it should sign hrefs expiring after another expiration", func(t *testing.T) {
+		u, err := url.Parse(signer.SignFor("/tee/some-id", 1*time.Minute))
+		require.NoError(t, err)
+		assert.NoError(t, signer.Verify(u.Path, u.Query()))
+
+		expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, expires, time.Now().Add(1*time.Minute).Unix())
+	})
+
+	t.Run("it should seal state into tokens only it can open", func(t *testing.T) {
+		token, err := signer.Seal([]byte(`{"header":{"Authorization":"Bearer secret-token"}}`))
+		require.NoError(t, err)
+		assert.NotContains(t, token, "secret-token")
+		assert.Equal(t, token, url.PathEscape(token))
+
+		state, err := signer.Open(token)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"header":{"Authorization":"Bearer secret-token"}}`, string(state))
+
+		other := NewHrefSigner("https://lfsproxy.example.com", []byte("other"), 1*time.Hour)
+		_, err = other.Open(token)
+		assert.ErrorIs(t, err, ErrHrefInvalidState)
+
+		tampered := []byte(token)
+		tampered[len(tampered)/2] ^= 1
+		_, err = signer.Open(string(tampered))
+		assert.ErrorIs(t, err, ErrHrefInvalidState)
+	})
+}
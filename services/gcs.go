@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/vela-games/lfsproxy/config"
+)
+
+func init() {
+	RegisterObjectStore("gcs", func(cfg *config.Config, bucket string) (ObjectStore, error) {
+		if bucket == "" {
+			bucket = cfg.GCSBucket
+		}
+
+		if bucket == "" {
+			return nil, errors.New("APP_GCS_BUCKET is required by the gcs storage backend")
+		}
+
+		var privateKey []byte
+		if cfg.GCSPrivateKeyFile != "" {
+			var err error
+			if privateKey, err = os.ReadFile(cfg.GCSPrivateKeyFile); err != nil {
+				return nil, fmt.Errorf("error reading GCS private key: %w", err)
+			}
+		}
+
+		return NewGCSService(bucket, cfg.GCSSignedURLExpiration, cfg.GCSGoogleAccessID, privateKey)
+	})
+}
+
+// GCS stores objects on a Google Cloud Storage bucket and hands out V4 signed URLs to them
+type GCS struct {
+	bucket              string
+	signedURLExpiration time.Duration
+	googleAccessID      string
+	privateKey          []byte
+	client              *storage.Client
+}
+
+// NewGCSService builds a GCS object store using Application Default Credentials.
+// googleAccessID and privateKey are optional, when empty they are detected from the credentials.
+// Setting STORAGE_EMULATOR_HOST points the client to a local fake GCS server
+func NewGCSService(bucket string, signedURLExpiration time.Duration, googleAccessID string, privateKey []byte) (ObjectStore, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCS{
+		bucket:              bucket,
+		signedURLExpiration: signedURLExpiration,
+		googleAccessID:      googleAccessID,
+		privateKey:          privateKey,
+		client:              client,
+	}, nil
+}
+
+func (g GCS) OIDExists(oid string) (bool, error) {
+	_, err := g.client.Bucket(g.bucket).Object(oid).Attrs(context.Background())
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (g GCS) URLExpiration() time.Duration {
+	return g.signedURLExpiration
+}
+
+func (g GCS) GetOIDPreSignedURL(oid string) (string, string, error) {
+	urlStr, err := g.signedURL(oid, "GET")
+	if err != nil {
+		return "", "", err
+	}
+
+	headUrlStr, err := g.signedURL(oid, "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+
+	return urlStr, headUrlStr, nil
+}
+
+func (g GCS) signedURL(oid string, method string) (string, error) {
+	return g.client.Bucket(g.bucket).SignedURL(oid, &storage.SignedURLOptions{
+		Scheme:         storage.SigningSchemeV4,
+		Method:         method,
+		Expires:        time.Now().Add(g.signedURLExpiration),
+		GoogleAccessID: g.googleAccessID,
+		PrivateKey:     g.privateKey,
+	})
+}
+
+func (g GCS) UploadOID(oid string, body io.ReadCloser) error {
+	defer body.Close()
+
+	// Cancelling the context aborts the upload so a failed read never leaves a partial object behind
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := g.client.Bucket(g.bucket).Object(oid).NewWriter(ctx)
+	if _, err := io.Copy(w, body); err != nil {
+		cancel()
+		// Fail the pending request right away instead of waiting for the writer to notice the cancellation,
+		// then wait for it to return
+		w.CloseWithError(err) //nolint:errcheck,staticcheck
+		w.Close()             //nolint:errcheck
+		return err
+	}
+
+	return w.Close()
+}
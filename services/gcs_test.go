@@ -0,0 +1,104 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeGCS(t *testing.T, objects ...fakestorage.Object) GCS {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{
+		InitialObjects: objects,
+		Scheme:         "http",
+		Host:           "127.0.0.1",
+	})
+	require.NoError(t, err)
+	t.Cleanup(server.Stop)
+
+	server.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "test-bucket"})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	return GCS{
+		bucket:              "test-bucket",
+		signedURLExpiration: 1 * time.Hour,
+		googleAccessID:      "lfsproxy@test-project.iam.gserviceaccount.com",
+		privateKey: pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}),
+		client: server.Client(),
+	}
+}
+
+func TestGCSOIDExists(t *testing.T) {
+	gcs := newFakeGCS(t, fakestorage.Object{
+		ObjectAttrs: fakestorage.ObjectAttrs{BucketName: "test-bucket", Name: "test-oid"},
+		Content:     []byte("content"),
+	})
+
+	t.Run("OIDExists return false because OID doesn't exist", func(t *testing.T) {
+		exists, err := gcs.OIDExists("missing-oid")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("OIDExists return true because OID exists", func(t *testing.T) {
+		exists, err := gcs.OIDExists("test-oid")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+}
+
+func TestGCSGetOIDPreSignedURL(t *testing.T) {
+	gcs := newFakeGCS(t)
+
+	urlStr, headUrlStr, err := gcs.GetOIDPreSignedURL("test-oid")
+	assert.NoError(t, err)
+	assert.NotEqual(t, urlStr, headUrlStr)
+
+	for _, s := range []string{urlStr, headUrlStr} {
+		u, err := url.Parse(s)
+		assert.NoError(t, err)
+		assert.Equal(t, "/test-bucket/test-oid", u.Path)
+		assert.Equal(t, "GOOG4-RSA-SHA256", u.Query().Get("X-Goog-Algorithm"))
+		assert.NotEmpty(t, u.Query().Get("X-Goog-Expires"))
+		assert.NotEmpty(t, u.Query().Get("X-Goog-Signature"))
+	}
+}
+
+func TestGCSUploadOID(t *testing.T) {
+	gcs := newFakeGCS(t)
+
+	err := gcs.UploadOID("test-oid", io.NopCloser(bytes.NewBufferString("content")))
+	assert.NoError(t, err)
+
+	exists, err := gcs.OIDExists("test-oid")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	err = gcs.UploadOID("broken-oid", io.NopCloser(io.MultiReader(bytes.NewBufferString("partial"), failingReader{})))
+	assert.Error(t, err)
+
+	exists, err = gcs.OIDExists("broken-oid")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// failingReader is a reader that always fails, used to simulate a broken upstream body
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
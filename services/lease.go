@@ -0,0 +1,53 @@
+package services
+
+import "time"
+
+// Leaser is implemented by object stores that can coordinate work on an object across proxy replicas.
+// A lease is held until it is released or its TTL expires, whichever comes first
+type Leaser interface {
+	AcquireLease(oid string, ttl time.Duration) (bool, error)
+	// RenewLease extends a lease held by the caller for another TTL, it returns false once the lease is lost
+	RenewLease(oid string, ttl time.Duration) (bool, error)
+	ReleaseLease(oid string) error
+}
+
+// AcquireLease acquires a lease on an object of the store. Stores that can't hold leases always grant them
+func AcquireLease(store ObjectStore, oid string, ttl time.Duration) (bool, error) {
+	if leaser, ok := store.(Leaser); ok {
+		return leaser.AcquireLease(oid, ttl)
+	}
+
+	return true, nil
+}
+
+// RenewLease renews a lease acquired with AcquireLease
+func RenewLease(store ObjectStore, oid string, ttl time.Duration) (bool, error) {
+	if leaser, ok := store.(Leaser); ok {
+		return leaser.RenewLease(oid, ttl)
+	}
+
+	return true, nil
+}
+
+// ReleaseLease releases a lease acquired with AcquireLease
+func ReleaseLease(store ObjectStore, oid string) error {
+	if leaser, ok := store.(Leaser); ok {
+		return leaser.ReleaseLease(oid)
+	}
+
+	return nil
+}
+
+// SupportsLeases tells whether a store can hold leases, rather than granting all of them
+func SupportsLeases(store ObjectStore) bool {
+	switch s := store.(type) {
+	case *Tiered:
+		return SupportsLeases(s.durable)
+	case *Prefixed:
+		return SupportsLeases(s.store)
+	case Leaser:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Prefixed stores the objects of another store under a key prefix
+type Prefixed struct {
+	store  ObjectStore
+	prefix string
+}
+
+func NewPrefixedStore(store ObjectStore, prefix string) *Prefixed {
+	return &Prefixed{
+		store:  store,
+		prefix: prefix,
+	}
+}
+
+// key returns the key of an object on the store, refusing oids that would leave the prefix
+func (p Prefixed) key(oid string) (string, error) {
+	key := path.Join(p.prefix, oid)
+	if oid == "" || !strings.HasPrefix(key, path.Clean(p.prefix)+"/") {
+		return "", fmt.Errorf("invalid object key %q", oid)
+	}
+
+	return key, nil
+}
+
+func (p Prefixed) OIDExists(oid string) (bool, error) {
+	key, err := p.key(oid)
+	if err != nil {
+		return false, err
+	}
+
+	return p.store.OIDExists(key)
+}
+
+func (p Prefixed) GetOIDPreSignedURL(oid string) (string, string, error) {
+	key, err := p.key(oid)
+	if err != nil {
+		return "", "", err
+	}
+
+	return p.store.GetOIDPreSignedURL(key)
+}
+
+func (p Prefixed) URLExpiration() time.Duration {
+	return p.store.URLExpiration()
+}
+
+func (p Prefixed) UploadOID(oid string, body io.ReadCloser) error {
+	key, err := p.key(oid)
+	if err != nil {
+		body.Close()
+		return err
+	}
+
+	return p.store.UploadOID(key, body)
+}
+
+func (p Prefixed) AcquireLease(oid string, ttl time.Duration) (bool, error) {
+	key, err := p.key(oid)
+	if err != nil {
+		return false, err
+	}
+
+	return AcquireLease(p.store, key, ttl)
+}
+
+func (p Prefixed) RenewLease(oid string, ttl time.Duration) (bool, error) {
+	key, err := p.key(oid)
+	if err != nil {
+		return false, err
+	}
+
+	return RenewLease(p.store, key, ttl)
+}
+
+func (p Prefixed) ReleaseLease(oid string) error {
+	key, err := p.key(oid)
+	if err != nil {
+		return err
+	}
+
+	return ReleaseLease(p.store, key)
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixedStore(t *testing.T) {
+	fs, err := NewFSService(t.TempDir(), NewHrefSigner("https://lfsproxy.example.com/", []byte("secret"), 1*time.Hour))
+	require.NoError(t, err)
+
+	require.NoError(t, fs.UploadOID("fake-git-server.com/secret.git/"+testOID, io.NopCloser(bytes.NewBufferString("secret"))))
+
+	store := NewPrefixedStore(fs, "fake-git-server.com/repository.git")
+
+	t.Run("it should store objects under the prefix", func(t *testing.T) {
+		require.NoError(t, store.UploadOID(testOID, io.NopCloser(bytes.NewBufferString("content"))))
+
+		exists, err := fs.OIDExists("fake-git-server.com/repository.git/" + testOID)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("it should refuse keys leaving the prefix", func(t *testing.T) {
+		for _, oid := range []string{"../secret.git/" + testOID, "a/../../secret.git/" + testOID, "..", ""} {
+			exists, err := store.OIDExists(oid)
+			assert.Error(t, err, oid)
+			assert.False(t, exists, oid)
+
+			_, _, err = store.GetOIDPreSignedURL(oid)
+			assert.Error(t, err, oid)
+
+			assert.Error(t, store.UploadOID(oid, io.NopCloser(bytes.NewBufferString("content"))), oid)
+		}
+	})
+}
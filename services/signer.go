@@ -0,0 +1,161 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vela-games/lfsproxy/config"
+)
+
+var (
+	ErrHrefExpired          = errors.New("href expired")
+	ErrHrefInvalidSignature = errors.New("invalid href signature")
+	ErrHrefInvalidState     = errors.New("invalid href state")
+)
+
+// HrefSigner signs and verifies expiring hrefs to objects served by the proxy itself.
+// It plays the role presigned URLs play for object stores that clients can't reach directly
+type HrefSigner struct {
+	baseURL    string
+	key        []byte
+	expiration time.Duration
+}
+
+func NewHrefSigner(baseURL string, key []byte, expiration time.Duration) *HrefSigner {
+	return &HrefSigner{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		key:        key,
+		expiration: expiration,
+	}
+}
+
+// NewHrefSignerFromConfig builds the HrefSigner configured by APP_PROXY_BASE_URL and APP_PROXY_SIGNING_KEY
+func NewHrefSignerFromConfig(cfg *config.Config) (*HrefSigner, error) {
+	if cfg.ProxyBaseURL == "" || cfg.ProxySigningKey == "" {
+		return nil, errors.New("APP_PROXY_BASE_URL and APP_PROXY_SIGNING_KEY are required to serve objects through the proxy")
+	}
+
+	return NewHrefSigner(cfg.ProxyBaseURL, []byte(cfg.ProxySigningKey), cfg.ProxyHrefExpiration), nil
+}
+
+// Expiration returns how long signed hrefs stay valid
+func (s HrefSigner) Expiration() time.Duration {
+	return s.expiration
+}
+
+// Sign returns an absolute href to the given proxy path that expires after the configured expiration
+func (s HrefSigner) Sign(path string) string {
+	return s.SignFor(path, s.expiration)
+}
+
+// SignFor returns an absolute href to the given proxy path that expires after expiration,
+// for hrefs that must not outlive something else than the configured expiration
+func (s HrefSigner) SignFor(path string, expiration time.Duration) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(time.Now().Add(expiration).Unix(), 10))
+	query.Set("signature", s.mac(path, query))
+
+	return s.baseURL + path + "?" + query.Encode()
+}
+
+// Verify checks that query carries a valid, unexpired signature for path
+func (s HrefSigner) Verify(path string, query url.Values) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrHrefInvalidSignature
+	}
+
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return ErrHrefInvalidSignature
+	}
+
+	expected, _ := hex.DecodeString(s.mac(path, query))
+	if !hmac.Equal(signature, expected) {
+		return ErrHrefInvalidSignature
+	}
+
+	if time.Now().Unix() > expires {
+		return ErrHrefExpired
+	}
+
+	return nil
+}
+
+// Seal encrypts state into a token hrefs can carry, so whichever replica serves the href gets the state back
+// without the proxy keeping it anywhere, see Open
+func (s HrefSigner) Seal(state []byte) (string, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, state, nil)), nil
+}
+
+// Open decrypts a token returned by Seal, failing with ErrHrefInvalidState if it was tampered with
+func (s HrefSigner) Open(token string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrHrefInvalidState
+	}
+
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrHrefInvalidState
+	}
+
+	state, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrHrefInvalidState
+	}
+
+	return state, nil
+}
+
+// aead derives the key state is sealed with from the signing key
+func (s HrefSigner) aead() (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("href state"))
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// mac signs the path together with every query parameter but the signature itself
+func (s HrefSigner) mac(path string, query url.Values) string {
+	signed := url.Values{}
+	for k, v := range query {
+		if k != "signature" {
+			signed[k] = v
+		}
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(path + "?" + signed.Encode()))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vela-games/lfsproxy/config"
+)
+
+// ObjectStore is a storage backend able to hold LFS objects and hand out URLs to them
+type ObjectStore interface {
+	OIDExists(oid string) (bool, error)
+	GetOIDPreSignedURL(oid string) (string, string, error)
+	UploadOID(oid string, body io.ReadCloser) error
+	// URLExpiration returns how long the URLs handed out by GetOIDPreSignedURL stay valid, zero when they don't expire
+	URLExpiration() time.Duration
+}
+
+// ObjectInfo describes an object served by the proxy itself
+type ObjectInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// ObjectOpener is implemented by object stores whose objects are served by the proxy itself
+// instead of by the store through presigned URLs
+type ObjectOpener interface {
+	OpenOID(ctx context.Context, oid string) (io.ReadSeekCloser, ObjectInfo, error)
+}
+
+// RangeHinter is implemented by readers returned by OpenOID that download objects lazily. Told the range
+// a request reads, from start up to end excluded, they only download that range rather than the rest of the object
+type RangeHinter interface {
+	HintRange(start int64, end int64)
+}
+
+// ObjectRedirector is implemented by object stores that can point clients elsewhere
+// when an object they used to serve through the proxy is no longer available locally
+type ObjectRedirector interface {
+	RedirectURL(oid string) (string, error)
+}
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStoreFactory builds an ObjectStore from the proxy configuration. A non-empty bucket overrides
+// the bucket (or container) configured for the backend, as routes do for their repositories
+type ObjectStoreFactory func(cfg *config.Config, bucket string) (ObjectStore, error)
+
+var (
+	objectStoresMu sync.RWMutex
+	objectStores   = map[string]ObjectStoreFactory{}
+)
+
+// RegisterObjectStore makes a storage backend available under the given name.
+// Backends register themselves from init so they can be selected with APP_STORAGE_BACKEND
+func RegisterObjectStore(name string, factory ObjectStoreFactory) {
+	objectStoresMu.Lock()
+	defer objectStoresMu.Unlock()
+
+	if factory == nil {
+		panic("services: RegisterObjectStore factory is nil")
+	}
+
+	if _, dup := objectStores[name]; dup {
+		panic("services: RegisterObjectStore called twice for backend " + name)
+	}
+
+	objectStores[name] = factory
+}
+
+// ObjectStores returns the sorted names of the registered storage backends
+func ObjectStores() []string {
+	objectStoresMu.RLock()
+	defer objectStoresMu.RUnlock()
+
+	names := make([]string, 0, len(objectStores))
+	for name := range objectStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewObjectStore builds the storage backend selected by cfg.StorageBackend,
+// fronted by a local disk tier when APP_DISK_CACHE_ENABLED is set
+func NewObjectStore(cfg *config.Config) (ObjectStore, error) {
+	stores, err := NewObjectStores(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return stores[""], nil
+}
+
+// NewObjectStores builds the storage backend selected by cfg.StorageBackend once for the configured bucket,
+// stored under the "" key, and once for each of the extra buckets. All of them share the same disk tier
+func NewObjectStores(cfg *config.Config, buckets []string) (map[string]ObjectStore, error) {
+	objectStoresMu.RLock()
+	factory, ok := objectStores[cfg.StorageBackend]
+	objectStoresMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q, available backends: %v", cfg.StorageBackend, ObjectStores())
+	}
+
+	var diskTier *DiskTier
+	if cfg.DiskCacheEnabled {
+		var err error
+		if diskTier, err = newDiskTierFromConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	stores := map[string]ObjectStore{}
+	for _, bucket := range append([]string{""}, buckets...) {
+		store, err := factory(cfg, bucket)
+		if err != nil {
+			return nil, err
+		}
+
+		if diskTier != nil {
+			store = diskTier.Front(bucket, store)
+		}
+
+		stores[bucket] = store
+	}
+
+	return stores, nil
+}
+
+func newDiskTierFromConfig(cfg *config.Config) (*DiskTier, error) {
+	if cfg.DiskCachePath == "" || cfg.DiskCacheMaxBytes <= 0 {
+		return nil, errors.New("APP_DISK_CACHE_PATH and APP_DISK_CACHE_MAX_BYTES are required by the disk cache")
+	}
+
+	signer, err := NewHrefSignerFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	disk, err := NewFSService(cfg.DiskCachePath, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDiskTier(disk, cfg.DiskCacheMaxBytes)
+}
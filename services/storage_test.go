@@ -0,0 +1,93 @@
+package services
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vela-games/lfsproxy/config"
+)
+
+type fakeObjectStore struct {
+	bucket string
+}
+
+func (f fakeObjectStore) OIDExists(oid string) (bool, error) {
+	return false, nil
+}
+
+func (f fakeObjectStore) GetOIDPreSignedURL(oid string) (string, string, error) {
+	return "", "", nil
+}
+
+func (f fakeObjectStore) UploadOID(oid string, body io.ReadCloser) error {
+	return body.Close()
+}
+
+func (f fakeObjectStore) URLExpiration() time.Duration {
+	return time.Hour
+}
+
+func init() {
+	RegisterObjectStore("fake", func(cfg *config.Config, bucket string) (ObjectStore, error) {
+		return fakeObjectStore{bucket: bucket}, nil
+	})
+}
+
+func TestNewObjectStore(t *testing.T) {
+	t.Run("it should build the configured backend", func(t *testing.T) {
+		store, err := NewObjectStore(&config.Config{StorageBackend: "fake"})
+		assert.NoError(t, err)
+		assert.Equal(t, fakeObjectStore{}, store)
+	})
+
+	t.Run("it should hand the buckets overridden by routes to the backend", func(t *testing.T) {
+		stores, err := NewObjectStores(&config.Config{StorageBackend: "fake"}, []string{"other-bucket"})
+		assert.NoError(t, err)
+		assert.Equal(t, fakeObjectStore{}, stores[""])
+		assert.Equal(t, fakeObjectStore{bucket: "other-bucket"}, stores["other-bucket"])
+	})
+
+	t.Run("it should store the buckets of the fs backend on sub-directories of its root", func(t *testing.T) {
+		root := t.TempDir()
+		stores, err := NewObjectStores(&config.Config{StorageBackend: "fs", FSRoot: root, ProxyBaseURL: "http://localhost", ProxySigningKey: "secret", ProxyHrefExpiration: time.Hour}, []string{"other-bucket"})
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(root, "other-bucket"), stores["other-bucket"].(*FS).root)
+	})
+
+	t.Run("it should expire the URLs of tiered stores with the shortest of its tiers", func(t *testing.T) {
+		stores, err := NewObjectStores(&config.Config{
+			StorageBackend:      "fake",
+			DiskCacheEnabled:    true,
+			DiskCachePath:       t.TempDir(),
+			DiskCacheMaxBytes:   1024,
+			ProxyBaseURL:        "http://localhost",
+			ProxySigningKey:     "secret",
+			ProxyHrefExpiration: 30 * time.Minute,
+		}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 30*time.Minute, stores[""].URLExpiration())
+	})
+
+	t.Run("it should fail on unknown backends", func(t *testing.T) {
+		_, err := NewObjectStore(&config.Config{StorageBackend: "does-not-exist"})
+		assert.ErrorContains(t, err, "unknown storage backend")
+	})
+
+	t.Run("s3 backend requires a bucket", func(t *testing.T) {
+		_, err := NewObjectStore(&config.Config{StorageBackend: "s3"})
+		assert.ErrorContains(t, err, "APP_S3_BUCKET")
+	})
+
+	t.Run("it should panic when registering a backend twice", func(t *testing.T) {
+		assert.Panics(t, func() {
+			RegisterObjectStore("fake", func(cfg *config.Config, bucket string) (ObjectStore, error) {
+				return fakeObjectStore{bucket: bucket}, nil
+			})
+		})
+	})
+
+	assert.Contains(t, ObjectStores(), "s3")
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// bucketsDir keeps the objects of bucket overrides on the disk tier apart from the ones of the configured bucket,
+// object keys never start with a dot
+const bucketsDir = ".buckets"
+
+// DiskTier is a bounded local disk holding hot objects, served by the proxy itself.
+// The least recently used objects are evicted once it grows past its size limit.
+// One DiskTier can front several durable stores, see Front
+type DiskTier struct {
+	disk *FS
+	lru  *diskLRU
+
+	promotions singleflight.Group
+	httpClient *http.Client
+}
+
+// Tiered keeps hot objects on a DiskTier in front of a durable object store.
+// Objects are looked up on disk first and then on the durable store,
+// durable hits are promoted to disk in the background
+type Tiered struct {
+	*DiskTier
+	durable ObjectStore
+	// diskPrefix is prepended to the keys of the durable store on disk, so buckets sharing the disk tier never collide
+	diskPrefix string
+}
+
+func NewDiskTier(disk *FS, maxBytes int64) (*DiskTier, error) {
+	t := &DiskTier{
+		disk:       disk,
+		httpClient: http.DefaultClient,
+	}
+
+	// Objects failing to be removed are indexed again on the next start
+	t.lru = newDiskLRU(maxBytes, func(oid string) {
+		if err := t.disk.Remove(oid); err != nil {
+			slog.ErrorContext(context.Background(), "error evicting object from disk", "key", oid, "error", err)
+		}
+	})
+
+	// Rebuild the index from what is already on disk, oldest first
+	objects, err := disk.List()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].ModTime.Before(objects[j].ModTime)
+	})
+
+	for _, object := range objects {
+		t.lru.add(object.Key, object.Size)
+	}
+
+	return t, nil
+}
+
+// Front puts the disk tier in front of the durable store of a bucket, "" being the configured bucket
+func (t *DiskTier) Front(bucket string, durable ObjectStore) *Tiered {
+	var diskPrefix string
+	if bucket != "" {
+		diskPrefix = path.Join(bucketsDir, bucket) + "/"
+	}
+
+	return &Tiered{
+		DiskTier:   t,
+		durable:    durable,
+		diskPrefix: diskPrefix,
+	}
+}
+
+// diskKey returns the key an object of the durable store is kept under on disk
+func (t *Tiered) diskKey(oid string) string {
+	return t.diskPrefix + oid
+}
+
+// durableKey returns the key of an object on the durable store. Hrefs to the disk tier carry the key on disk,
+// which is mapped back when they are served after the object was evicted
+func (t *Tiered) durableKey(key string) string {
+	return strings.TrimPrefix(key, t.diskPrefix)
+}
+
+func (t *Tiered) OIDExists(oid string) (bool, error) {
+	oid = t.durableKey(oid)
+	if t.lru.contains(t.diskKey(oid)) {
+		return true, nil
+	}
+
+	return t.durable.OIDExists(oid)
+}
+
+func (t *Tiered) GetOIDPreSignedURL(oid string) (string, string, error) {
+	if key := t.diskKey(oid); t.lru.touch(key) {
+		return t.disk.GetOIDPreSignedURL(key)
+	}
+
+	urlStr, headUrlStr, err := t.durable.GetOIDPreSignedURL(oid)
+	if err != nil {
+		return "", "", err
+	}
+
+	go t.promote(t.diskKey(oid), t.durableFetcher(oid, urlStr))
+
+	return urlStr, headUrlStr, nil
+}
+
+// URLExpiration returns the shortest expiration of the hrefs to the disk tier and the URLs of the durable store
+func (t *Tiered) URLExpiration() time.Duration {
+	expiration := t.durable.URLExpiration()
+	if disk := t.disk.URLExpiration(); expiration == 0 || (disk > 0 && disk < expiration) {
+		expiration = disk
+	}
+
+	return expiration
+}
+
+// UploadOID stores the object on disk first and uploads it to the durable store from there,
+// it is only indexed on the disk tier once it is durable
+func (t *Tiered) UploadOID(oid string, body io.ReadCloser) error {
+	key := t.diskKey(oid)
+	if err := t.disk.UploadOID(key, body); err != nil {
+		return err
+	}
+
+	file, info, err := t.disk.OpenOID(context.Background(), key)
+	if err != nil {
+		return err
+	}
+
+	if err := t.durable.UploadOID(oid, file); err != nil {
+		t.disk.Remove(key) //nolint:errcheck
+		return err
+	}
+
+	t.lru.add(key, info.Size)
+
+	return nil
+}
+
+// OpenOID opens objects on disk, or on the durable store when it is also served by the proxy
+func (t *Tiered) OpenOID(ctx context.Context, oid string) (io.ReadSeekCloser, ObjectInfo, error) {
+	oid = t.durableKey(oid)
+	if key := t.diskKey(oid); t.lru.touch(key) {
+		return t.disk.OpenOID(ctx, key)
+	}
+
+	if opener, ok := t.durable.(ObjectOpener); ok {
+		return opener.OpenOID(ctx, oid)
+	}
+
+	return nil, ObjectInfo{}, ErrObjectNotFound
+}
+
+// durableFetcher reads an object from the durable store directly when it is served by the proxy,
+// and through its download url otherwise
+func (t *Tiered) durableFetcher(oid string, urlStr string) func() (io.ReadCloser, error) {
+	if opener, ok := t.durable.(ObjectOpener); ok {
+		return func() (io.ReadCloser, error) {
+			body, _, err := opener.OpenOID(context.Background(), oid)
+			return body, err
+		}
+	}
+
+	return func() (io.ReadCloser, error) {
+		resp, err := t.httpClient.Get(urlStr)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %v", resp.StatusCode)
+		}
+
+		return resp.Body, nil
+	}
+}
+
+// RedirectURL points clients holding an href to an object evicted from disk to the durable store
+func (t *Tiered) RedirectURL(oid string) (string, error) {
+	urlStr, _, err := t.GetOIDPreSignedURL(t.durableKey(oid))
+
+	return urlStr, err
+}
+
+// AcquireLease leases objects on the durable store, the disk tier is local to each replica
+func (t *Tiered) AcquireLease(oid string, ttl time.Duration) (bool, error) {
+	return AcquireLease(t.durable, oid, ttl)
+}
+
+func (t *Tiered) RenewLease(oid string, ttl time.Duration) (bool, error) {
+	return RenewLease(t.durable, oid, ttl)
+}
+
+func (t *Tiered) ReleaseLease(oid string) error {
+	return ReleaseLease(t.durable, oid)
+}
+
+// promote copies an object from the durable store to disk under key. Concurrent promotions of an object are
+// coalesced, objects failing to be promoted are served by the durable store until their next download
+func (t *DiskTier) promote(key string, fetch func() (io.ReadCloser, error)) {
+	t.promotions.Do(key, func() (interface{}, error) { //nolint:errcheck
+		if t.lru.contains(key) {
+			return nil, nil
+		}
+
+		err := t.copyToDisk(key, fetch)
+		if err != nil {
+			slog.ErrorContext(context.Background(), "error promoting object to disk", "key", key, "error", err)
+		}
+
+		return nil, err
+	})
+}
+
+func (t *DiskTier) copyToDisk(key string, fetch func() (io.ReadCloser, error)) error {
+	body, err := fetch()
+	if err != nil {
+		return err
+	}
+
+	if err := t.disk.UploadOID(key, body); err != nil {
+		return err
+	}
+
+	info, err := t.disk.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	t.lru.add(key, info.Size)
+
+	return nil
+}
+
+// diskLRU indexes the objects on the disk tier by recency and evicts them past maxBytes
+type diskLRU struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+	evict    func(oid string)
+}
+
+type diskLRUEntry struct {
+	oid  string
+	size int64
+}
+
+func newDiskLRU(maxBytes int64, evict func(oid string)) *diskLRU {
+	return &diskLRU{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		evict:    evict,
+	}
+}
+
+func (d *diskLRU) contains(oid string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.entries[oid]
+
+	return ok
+}
+
+// touch marks the object as recently used, it returns false if the object is not on disk
+func (d *diskLRU) touch(oid string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.entries[oid]
+	if ok {
+		d.order.MoveToFront(e)
+	}
+
+	return ok
+}
+
+func (d *diskLRU) add(oid string, size int64) {
+	var evicted []string
+
+	d.mu.Lock()
+	if e, ok := d.entries[oid]; ok {
+		d.size -= e.Value.(*diskLRUEntry).size
+		d.order.Remove(e)
+	}
+
+	d.entries[oid] = d.order.PushFront(&diskLRUEntry{oid: oid, size: size})
+	d.size += size
+
+	for d.size > d.maxBytes && d.order.Len() > 0 {
+		e := d.order.Back()
+		entry := e.Value.(*diskLRUEntry)
+		d.order.Remove(e)
+		delete(d.entries, entry.oid)
+		d.size -= entry.size
+		evicted = append(evicted, entry.oid)
+	}
+	d.mu.Unlock()
+
+	for _, oid := range evicted {
+		d.evict(oid)
+	}
+}
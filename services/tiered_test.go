@@ -0,0 +1,206 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredService(t *testing.T) {
+	oids := []string{
+		strings.Repeat("a", 64),
+		strings.Repeat("b", 64),
+		strings.Repeat("c", 64),
+	}
+
+	// The durable tier is served over HTTP so promotions can download from it
+	var durable *FS
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, info, err := durable.OpenOID(r.Context(), strings.TrimPrefix(r.URL.Path, "/objects/"))
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		defer body.Close()
+		http.ServeContent(w, r, "", info.ModTime, body)
+	}))
+	defer server.Close()
+
+	durable, err := NewFSService(t.TempDir(), NewHrefSigner(server.URL, []byte("durable"), 1*time.Hour))
+	require.NoError(t, err)
+
+	diskRoot := t.TempDir()
+	disk, err := NewFSService(diskRoot, NewHrefSigner("https://lfsproxy.lan", []byte("disk"), 1*time.Hour))
+	require.NoError(t, err)
+
+	diskTier, err := NewDiskTier(disk, 25)
+	require.NoError(t, err)
+	tiered := diskTier.Front("", durable)
+
+	t.Run("it should store uploads on both tiers", func(t *testing.T) {
+		err := tiered.UploadOID(oids[0], io.NopCloser(bytes.NewBufferString("0123456789")))
+		assert.NoError(t, err)
+
+		exists, _ := disk.OIDExists(oids[0])
+		assert.True(t, exists)
+		exists, _ = durable.OIDExists(oids[0])
+		assert.True(t, exists)
+
+		urlStr, _, err := tiered.GetOIDPreSignedURL(oids[0])
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(urlStr, "https://lfsproxy.lan/objects/"))
+	})
+
+	t.Run("it should evict the least recently used objects from disk", func(t *testing.T) {
+		assert.NoError(t, tiered.UploadOID(oids[1], io.NopCloser(bytes.NewBufferString("0123456789"))))
+
+		// Touch the first object so the second one is the least recently used
+		_, _, err := tiered.OpenOID(context.TODO(), oids[0])
+		assert.NoError(t, err)
+
+		assert.NoError(t, tiered.UploadOID(oids[2], io.NopCloser(bytes.NewBufferString("0123456789"))))
+
+		exists, _ := disk.OIDExists(oids[1])
+		assert.False(t, exists)
+		exists, _ = disk.OIDExists(oids[0])
+		assert.True(t, exists)
+
+		exists, err = tiered.OIDExists(oids[1])
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		// The durable store is served by the proxy too, so evicted objects are opened from it
+		body, _, err := tiered.OpenOID(context.TODO(), oids[1])
+		assert.NoError(t, err)
+		body.Close()
+		assert.False(t, tiered.lru.contains(oids[1]))
+	})
+
+	t.Run("it should promote durable hits to disk", func(t *testing.T) {
+		urlStr, _, err := tiered.GetOIDPreSignedURL(oids[1])
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(urlStr, server.URL))
+
+		assert.Eventually(t, func() bool {
+			return tiered.lru.contains(oids[1])
+		}, 1*time.Second, 10*time.Millisecond)
+
+		urlStr, _, err = tiered.GetOIDPreSignedURL(oids[1])
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(urlStr, "https://lfsproxy.lan/objects/"))
+	})
+
+	t.Run("it should coalesce concurrent promotions of an object", func(t *testing.T) {
+		oid := strings.Repeat("d", 64)
+
+		var fetches atomic.Int32
+		release := make(chan struct{})
+		fetch := func() (io.ReadCloser, error) {
+			fetches.Add(1)
+			<-release
+			return io.NopCloser(bytes.NewBufferString("0123456789")), nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				diskTier.promote(oid, fetch)
+			}()
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), fetches.Load())
+		assert.True(t, diskTier.lru.contains(oid))
+
+		// Objects already on disk aren't fetched again
+		diskTier.promote(oid, fetch)
+		assert.Equal(t, int32(1), fetches.Load())
+	})
+
+	t.Run("it should rebuild the index from disk", func(t *testing.T) {
+		restarted, err := NewDiskTier(disk, 25)
+		require.NoError(t, err)
+
+		for _, oid := range oids {
+			onDisk, _ := disk.OIDExists(oid)
+			assert.Equal(t, onDisk, restarted.lru.contains(oid), oid)
+		}
+	})
+}
+
+func TestTieredServiceBuckets(t *testing.T) {
+	oid := strings.Repeat("a", 64)
+
+	disk, err := NewFSService(t.TempDir(), NewHrefSigner("https://lfsproxy.lan", []byte("disk"), 1*time.Hour))
+	require.NoError(t, err)
+
+	diskTier, err := NewDiskTier(disk, 25)
+	require.NoError(t, err)
+
+	durable, err := NewFSService(t.TempDir(), NewHrefSigner("https://durable.lan", []byte("durable"), 1*time.Hour))
+	require.NoError(t, err)
+	other, err := NewFSService(t.TempDir(), NewHrefSigner("https://other.lan", []byte("other"), 1*time.Hour))
+	require.NoError(t, err)
+
+	tiered := diskTier.Front("", durable)
+	otherTiered := diskTier.Front("other-bucket", other)
+
+	require.NoError(t, tiered.UploadOID(oid, io.NopCloser(bytes.NewBufferString("0123456789"))))
+	require.NoError(t, otherTiered.UploadOID(oid, io.NopCloser(bytes.NewBufferString("9876543210"))))
+
+	read := func(store *Tiered, key string) string {
+		body, _, err := store.OpenOID(context.TODO(), key)
+		require.NoError(t, err)
+		defer body.Close()
+
+		content, err := io.ReadAll(body)
+		require.NoError(t, err)
+
+		return string(content)
+	}
+
+	t.Run("it should keep the objects of each bucket apart on disk", func(t *testing.T) {
+		assert.Equal(t, "0123456789", read(tiered, oid))
+		assert.Equal(t, "9876543210", read(otherTiered, oid))
+	})
+
+	t.Run("it should serve hrefs to the disk tier after the object was evicted", func(t *testing.T) {
+		urlStr, _, err := otherTiered.GetOIDPreSignedURL(oid)
+		require.NoError(t, err)
+
+		u, err := url.Parse(urlStr)
+		require.NoError(t, err)
+		key := strings.TrimPrefix(u.Path, "/objects/")
+		assert.Equal(t, ".buckets/other-bucket/"+oid, key)
+
+		// Evict the object by filling the disk tier
+		require.NoError(t, tiered.UploadOID(strings.Repeat("b", 64), io.NopCloser(bytes.NewBufferString("0123456789"))))
+		require.NoError(t, tiered.UploadOID(strings.Repeat("c", 64), io.NopCloser(bytes.NewBufferString("0123456789"))))
+		require.False(t, diskTier.lru.contains(key))
+
+		exists, err := otherTiered.OIDExists(key)
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, "9876543210", read(otherTiered, key))
+
+		urlStr, err = otherTiered.RedirectURL(key)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(urlStr, "https://other.lan/objects/"+oid), urlStr)
+	})
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+var ErrContentMismatch = errors.New("content does not match the object")
+
+// VerifyingReader checks that the content read hashes to the OID and has the expected size.
+// It fails the last read on a mismatch so object stores abort the upload instead of keeping a corrupted object
+type VerifyingReader struct {
+	body io.ReadCloser
+	hash hash.Hash
+	oid  string
+	size int64
+	read int64
+}
+
+func NewVerifyingReader(body io.ReadCloser, oid string, size int64) *VerifyingReader {
+	return &VerifyingReader{
+		body: body,
+		hash: sha256.New(),
+		oid:  oid,
+		size: size,
+	}
+}
+
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.body.Read(p)
+	v.read += int64(n)
+	v.hash.Write(p[:n])
+
+	if v.read > v.size {
+		return n, fmt.Errorf("%w: %v is larger than %d bytes", ErrContentMismatch, v.oid, v.size)
+	}
+
+	if errors.Is(err, io.EOF) {
+		if v.read != v.size {
+			return n, fmt.Errorf("%w: %v has %d bytes, expected %d", ErrContentMismatch, v.oid, v.read, v.size)
+		}
+
+		if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != v.oid {
+			return n, fmt.Errorf("%w: %v hashes to %v", ErrContentMismatch, v.oid, sum)
+		}
+	}
+
+	return n, err
+}
+
+func (v *VerifyingReader) Close() error {
+	return v.body.Close()
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	// sha256 of "0123456789"
+	oid := "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+	read := func(content string, size int64) ([]byte, error) {
+		return io.ReadAll(NewVerifyingReader(io.NopCloser(bytes.NewBufferString(content)), oid, size))
+	}
+
+	t.Run("it should read matching content", func(t *testing.T) {
+		content, err := read("0123456789", 10)
+		assert.NoError(t, err)
+		assert.Equal(t, "0123456789", string(content))
+	})
+
+	t.Run("it should fail truncated content", func(t *testing.T) {
+		_, err := read("01234", 10)
+		assert.ErrorIs(t, err, ErrContentMismatch)
+	})
+
+	t.Run("it should fail content larger than the object", func(t *testing.T) {
+		_, err := read("0123456789", 5)
+		assert.ErrorIs(t, err, ErrContentMismatch)
+	})
+
+	t.Run("it should fail corrupted content", func(t *testing.T) {
+		_, err := read("0123456780", 10)
+		assert.ErrorIs(t, err, ErrContentMismatch)
+	})
+
+	t.Run("it should not keep mismatching uploads", func(t *testing.T) {
+		fs, err := NewFSService(t.TempDir(), NewHrefSigner("http://localhost:9999", []byte("secret"), 0))
+		assert.NoError(t, err)
+
+		err = fs.UploadOID(oid, NewVerifyingReader(io.NopCloser(bytes.NewBufferString("0123456780")), oid, 10))
+		assert.ErrorIs(t, err, ErrContentMismatch)
+
+		exists, err := fs.OIDExists(oid)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	SetPropagator()
+
+	t.Run("it should carry nothing outside of a span", func(t *testing.T) {
+		assert.Nil(t, Carrier(context.Background()))
+
+		_, span := Link(context.Background(), "detached", nil)
+		span.End()
+
+		assert.Empty(t, exporter.GetSpans()[0].Links)
+		exporter.Reset()
+	})
+
+	t.Run("it should link detached work to the span it was started by", func(t *testing.T) {
+		ctx, origin := Start(context.Background(), "origin")
+		carrier := Carrier(ctx)
+		origin.End()
+
+		_, span := Link(context.Background(), "detached", carrier)
+		span.End()
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 2)
+		assert.NotEqual(t, spans[0].SpanContext.TraceID(), spans[1].SpanContext.TraceID())
+		require.Len(t, spans[1].Links, 1)
+		assert.Equal(t, spans[0].SpanContext.SpanID(), spans[1].Links[0].SpanContext.SpanID())
+		exporter.Reset()
+	})
+
+	t.Run("it should mark server errors on the request span", func(t *testing.T) {
+		_, r := gin.CreateTestContext(httptest.NewRecorder())
+		r.Use(Middleware())
+		r.GET("/some-path/:id", func(c *gin.Context) {
+			c.Status(http.StatusBadGateway)
+		})
+
+		req, _ := http.NewRequest("GET", "/some-path/1", nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		assert.Equal(t, "GET /some-path/:id", spans[0].Name)
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+		exporter.Reset()
+	})
+}